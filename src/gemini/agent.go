@@ -1,9 +1,11 @@
-package gemini  
+package gemini
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cvm/cvmagent/channel"
@@ -12,93 +14,519 @@ import (
 type libagent struct {
 	protocol   string
 	url        string
-	conn       net.Conn
 	ctlChannel channel.MessageChannel
+
+	// timeout bounds each call, none when 0
+	timeout time.Duration
+
+	// set up by Init
+	sync.Mutex
+	conn net.Conn
+	// id of the last request, and the calls waiting for a reply by id
+	lastID  uint64
+	pending map[uint64]chan channel.Message
+	// notification channels, with the message types each one receives
+	subscribers map[chan channel.Message][]int
+	// closed once the agent announced itself
+	ready     chan struct{}
+	readyOnce sync.Once
+	exitChan  chan *channel.ContainerExitMessage
+	execs     map[string]*agentProcess
+	// closed once dispatch handled the last message of the connection
+	stopped chan struct{}
+
+	// protocol version and features agreed by Hello
+	version  int
+	features []string
 }
 
-func (l *libagent) Init() error {
-	l.ctlChannel = channel.MessageChannel{}
-	// open channel
+// AgentTimeoutError is returned by an agent call the guest did not answer in
+// time.
+type AgentTimeoutError struct {
+	Call    string
+	Timeout time.Duration
+}
+
+func (e *AgentTimeoutError) Error() string {
+	return fmt.Sprintf("gemini: agent did not answer %s within %s", e.Call, e.Timeout)
+}
+
+// errAgentCanceled is returned by an agent call given up by its caller.
+var errAgentCanceled = errors.New("agent call canceled")
+
+// subscriberBuffer is how many notifications a subscriber may fall behind
+// before the next ones are dropped.
+const subscriberBuffer = 64
+
+// Dial connects to the agent socket, Init takes the connection over.
+func (l *libagent) Dial() (net.Conn, error) {
 	conn, err := net.Dial(l.protocol, l.url)
 	if err != nil {
 		log.Errorf("Open sock error: %s", err)
-		return err
+		return nil, err
 	}
-	l.conn = conn
+	return conn, nil
+}
 
-	if err := l.ctlChannel.Init(l.conn, l.conn); err != nil {
+// Init starts dispatching the messages the agent sends on conn. The agent
+// owns conn from then on, Init closes it when it fails.
+func (l *libagent) Init(conn net.Conn) error {
+	l.ctlChannel = channel.MessageChannel{}
+	if err := l.ctlChannel.Init(conn, conn); err != nil {
 		log.Error(err)
+		conn.Close()
 		return err
 	}
+
+	l.Lock()
+	l.conn = conn
+	l.pending = make(map[uint64]chan channel.Message)
+	l.subscribers = make(map[chan channel.Message][]int)
+	l.ready = make(chan struct{})
+	l.exitChan = make(chan *channel.ContainerExitMessage, 1)
+	l.execs = make(map[string]*agentProcess)
+	l.stopped = make(chan struct{})
+	l.Unlock()
+	go l.dispatch()
+	return nil
+}
+
+// dispatch hands each reply to the call waiting for it and each
+// notification to its process, WaitExit and the subscribers. Once the
+// connection ended it releases them all.
+func (l *libagent) dispatch() {
+	defer l.shutdown()
+	for msg := range l.ctlChannel.GetInputMessageChan() {
+		if msg.ID == 0 {
+			l.notify(msg)
+			continue
+		}
+		l.Lock()
+		reply, ok := l.pending[msg.ID]
+		delete(l.pending, msg.ID)
+		l.Unlock()
+		if !ok {
+			log.Warnf("Unexpected reply %d of type %d", msg.ID, msg.Type)
+			continue
+		}
+		reply <- msg
+	}
+}
+
+// shutdown fails the pending calls and the processes, and closes the
+// subscriber channels. Calls made afterwards fail at once.
+func (l *libagent) shutdown() {
+	log.Infof("Agent connection closed: %s", l.ctlChannel.Err())
+	l.Lock()
+	defer l.Unlock()
+	for _, reply := range l.pending {
+		close(reply)
+	}
+	l.pending = nil
+	for sub := range l.subscribers {
+		close(sub)
+	}
+	l.subscribers = nil
+	for _, p := range l.execs {
+		p.end(nil)
+	}
+	l.execs = nil
+	close(l.stopped)
+}
+
+// connError is the error of the calls cut short by the end of the
+// connection.
+func (l *libagent) connError() error {
+	return fmt.Errorf("agent connection closed: %s", l.ctlChannel.Err())
+}
+
+func (l *libagent) notify(msg channel.Message) {
+	payload, err := channel.Decode(msg)
+	if err != nil {
+		log.Errorf("Recv notification error: %s", err)
+		return
+	}
+	switch msg.Type {
+	case channel.MSG_AGENT_HELLO:
+		l.readyOnce.Do(func() { close(l.ready) })
+	case channel.MSG_CONTAINER_EXIT:
+		select {
+		case l.exitChan <- payload.(*channel.ContainerExitMessage):
+		default:
+			log.Warn("Container exit reported twice")
+		}
+	case channel.MSG_OOM:
+		log.Warn("Container hit its memory limit")
+	case channel.MSG_OUTPUT:
+		streammsg := payload.(*channel.StreamMessage)
+		if p := l.process(streammsg.ID); p != nil {
+			p.output(streammsg)
+		}
+	case channel.MSG_EXEC_EXIT:
+		exitmsg := payload.(*channel.ExecExitMessage)
+		if p := l.process(exitmsg.ID); p != nil {
+			l.detach(exitmsg.ID)
+			p.end(exitmsg)
+		}
+	default:
+		log.Warnf("Unexpected message type %d", msg.Type)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for sub, types := range l.subscribers {
+		for _, t := range types {
+			if t != msg.Type {
+				continue
+			}
+			select {
+			case sub <- msg:
+			default:
+				log.Warnf("Notification of type %d dropped, subscriber is behind", msg.Type)
+			}
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the notifications of the given types
+// sent by the agent from now on, and the function that cancels it.
+// Notifications are dropped while the subscriber is behind, the channel is
+// closed with the connection.
+func (l *libagent) Subscribe(types ...int) (<-chan channel.Message, func()) {
+	sub := make(chan channel.Message, subscriberBuffer)
+	l.Lock()
+	if l.subscribers == nil {
+		close(sub)
+	} else {
+		l.subscribers[sub] = types
+	}
+	l.Unlock()
+	return sub, func() {
+		l.Lock()
+		delete(l.subscribers, sub)
+		l.Unlock()
+	}
+}
+
+// call sends the request what to the agent and waits for the reply carrying
+// its id. It returns the decoded reply, an *AckMessage for most requests. The
+// wait is given up when cancel is closed and after the call timeout. It may be
+// called from several goroutines at once.
+func (l *libagent) call(cancel <-chan struct{}, what string, msgType int, content interface{}) (interface{}, error) {
+	return l.callWithin(cancel, what, l.timeout, msgType, content)
+}
+
+// callWithin is call bounded by timeout instead of the call timeout, none
+// when 0.
+func (l *libagent) callWithin(cancel <-chan struct{}, what string, timeout time.Duration, msgType int, content interface{}) (interface{}, error) {
+	reply := make(chan channel.Message, 1)
+	l.Lock()
+	if l.pending == nil {
+		l.Unlock()
+		return nil, l.connError()
+	}
+	l.lastID++
+	id := l.lastID
+	l.pending[id] = reply
+	l.Unlock()
+
+	if err := l.ctlChannel.Send(id, msgType, content); err != nil {
+		l.forget(id)
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return nil, l.connError()
+		}
+		return channel.Decode(msg)
+	case <-cancel:
+		l.forget(id)
+		return nil, errAgentCanceled
+	case <-expired:
+		l.forget(id)
+		return nil, &AgentTimeoutError{Call: what, Timeout: timeout}
+	}
+}
+
+// forget drops the call waiting for the reply to request id, the reply is
+// ignored if it comes later.
+func (l *libagent) forget(id uint64) {
+	l.Lock()
+	delete(l.pending, id)
+	l.Unlock()
+}
+
+// request sends a request the agent answers with an ack, and fails when the
+// ack is an error.
+func (l *libagent) request(cancel <-chan struct{}, what string, msgType int, content interface{}) error {
+	reply, err := l.call(cancel, what, msgType, content)
+	if err != nil {
+		log.Errorf("%s error: %s", what, err)
+		if _, ok := err.(*AgentTimeoutError); ok || err == errAgentCanceled {
+			return err
+		}
+		return fmt.Errorf("%s error: %s", what, err)
+	}
+	ack, ok := reply.(*channel.AckMessage)
+	if !ok {
+		return fmt.Errorf("%s error: unexpected reply %T", what, reply)
+	}
+	log.Info("Recv: MSG_ACK")
+	if err := ackError(ack); err != nil {
+		log.Errorf("%s error: %s", what, err)
+		return errors.New(what + " error:" + err.Error())
+	}
+	log.Infof("%s success", what)
+	return nil
+}
+
+// ackError returns the error ack carries, nil for ACK_OK.
+func ackError(ack *channel.AckMessage) error {
+	if ack.AckType != channel.ACK_OK {
+		return errors.New(ack.AckMsg)
+	}
 	return nil
 }
 
-func (l *libagent) IsReady() {
-	// receive ready message
-	for {
-		msg := <-l.ctlChannel.GetInputMessageChan()
-		if msg.Type == channel.MSG_AGENT_READY {
-			log.Info("Recv: MSG_AGENT_READY")
-			break
+// IsReady waits for the agent to announce itself, then agrees on the
+// protocol with it. The guest may take long to boot, the wait for the
+// announce has no timeout but cancel.
+func (l *libagent) IsReady(cancel <-chan struct{}) error {
+	select {
+	case <-l.ready:
+	case <-l.ctlChannel.Done():
+		if l.ctlChannel.Err() == channel.ErrLegacyPeer {
+			return fmt.Errorf("the guest agent is too old, it predates protocol version %d: update the initramfs", channel.MIN_PROTOCOL_VERSION)
 		}
+		return l.connError()
+	case <-cancel:
+		return errAgentCanceled
 	}
+	log.Info("Recv: MSG_AGENT_HELLO")
+	return l.Hello(cancel)
+}
+
+// Hello exchanges the protocol versions and features with the agent. It
+// fails when they have no version in common.
+func (l *libagent) Hello(cancel <-chan struct{}) error {
+	local := channel.NewHello()
+	reply, err := l.call(cancel, "Hello", channel.MSG_HELLO, local)
+	if err != nil {
+		return err
+	}
+	switch reply := reply.(type) {
+	case *channel.HelloMessage:
+		version, features, err := channel.Negotiate(local, *reply)
+		if err != nil {
+			return err
+		}
+		codec := channel.NegotiateCodec(local, *reply)
+		l.ctlChannel.SetCodec(codec)
+		log.Infof("Agent protocol version %d, features %v, codec %s", version, features, codec.Name())
+		l.Lock()
+		l.version, l.features = version, features
+		l.Unlock()
+		return nil
+	case *channel.AckMessage:
+		if err := ackError(reply); err != nil {
+			return errors.New("Hello error:" + err.Error())
+		}
+	}
+	return fmt.Errorf("Hello error: unexpected reply %T", reply)
+}
+
+// supports fails unless the agent advertised feature.
+func (l *libagent) supports(feature string) error {
+	l.Lock()
+	defer l.Unlock()
+	for _, f := range l.features {
+		if f == feature {
+			return nil
+		}
+	}
+	return fmt.Errorf("the guest agent does not support %s", feature)
+}
+
+func (l *libagent) process(id string) *agentProcess {
+	l.Lock()
+	defer l.Unlock()
+	return l.execs[id]
 }
 
-func (l *libagent) SetIP(device, ip, mask string) error {
-	msg := channel.Message{Type: channel.MSG_SET_IP,
-		Content: channel.SetIPMessage{
+func (l *libagent) SetIP(cancel <-chan struct{}, device, ip, mask string) error {
+	return l.request(cancel, "Set ip", channel.MSG_SET_IP,
+		channel.SetIPMessage{
 			IfName:  device,
 			IpAddr:  ip,
-			NetMask: mask}}
-	l.ctlChannel.SendMessage(msg)
-	//receive ack
-	for {
-		msg := <-l.ctlChannel.GetInputMessageChan()
-		if msg.Type == channel.MSG_ACK {
-			log.Info("Recv: MSG_ACK")
-			ackmsg := channel.AckMessage{}
-			b, _ := json.Marshal(msg.Content)
-			json.Unmarshal(b, &ackmsg)
-			if ackmsg.AckType == channel.ACK_OK {
-				log.Info("Set Ip success")
-				return nil
-			} else {
-				log.Errorf("Set ip error: %s", ackmsg.AckMsg)
-				return errors.New("Set ip error:" + ackmsg.AckMsg)
-			}
+			NetMask: mask})
+}
+
+func (l *libagent) AddContainer(cancel <-chan struct{}, rootfs string, cmdArgs []string, env []string, memory, memorySwap int64, tty bool) error {
+	if tty {
+		if err := l.supports(channel.FEATURE_TTY); err != nil {
+			return err
 		}
 	}
+	return l.request(cancel, "Add container", channel.MSG_ADD_CONTAINER,
+		channel.AddContainerMessage{
+			Rootfs:     rootfs,
+			CmdArgs:    cmdArgs,
+			Env:        env,
+			Memory:     memory,
+			MemorySwap: memorySwap,
+			Tty:        tty,
+		})
+}
+
+// StopContainer asks the agent to send SIGTERM to the workload.
+func (l *libagent) StopContainer(cancel <-chan struct{}) error {
+	if err := l.supports(channel.FEATURE_STOP); err != nil {
+		return err
+	}
+	return l.request(cancel, "Stop container", channel.MSG_STOP_CONTAINER,
+		channel.StopContainerMessage{})
+}
+
+// Signal asks the agent to send sig to the workload, or to its whole process
+// group when all is set.
+func (l *libagent) Signal(cancel <-chan struct{}, sig int, all bool) error {
+	if err := l.supports(channel.FEATURE_SIGNAL); err != nil {
+		return err
+	}
+	return l.request(cancel, "Signal", channel.MSG_SIGNAL,
+		channel.SignalMessage{
+			Signal: sig,
+			All:    all})
+}
+
+// Attach routes the streams and exit of the guest process id to p, and
+// starts its output goroutine.
+func (l *libagent) Attach(id string, p *agentProcess) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.execs == nil {
+		return fmt.Errorf("Attach %s: agent is not connected", id)
+	}
+	p.id = id
+	p.agent = l
+	p.start()
+	l.execs[id] = p
+	return nil
+}
+
+func (l *libagent) detach(id string) {
+	l.Lock()
+	delete(l.execs, id)
+	l.Unlock()
+}
+
+// Exec starts an extra process in the running container.
+func (l *libagent) Exec(cancel <-chan struct{}, exec channel.ExecMessage, p *agentProcess) error {
+	if err := l.supports(channel.FEATURE_EXEC); err != nil {
+		return err
+	}
+	if exec.Tty {
+		if err := l.supports(channel.FEATURE_TTY); err != nil {
+			return err
+		}
+	}
+	if err := l.Attach(exec.ID, p); err != nil {
+		return err
+	}
+	if err := l.request(cancel, "Exec", channel.MSG_EXEC, exec); err != nil {
+		l.detach(exec.ID)
+		p.end(nil)
+		return err
+	}
+	return nil
+}
+
+// Stdin sends data to the stdin of process id. An agent with
+// FEATURE_STDIN_ACK acks the data once it has room for it, which Stdin waits
+// for with no timeout: the process may not read its stdin for long. Other
+// agents get it with no ack.
+func (l *libagent) Stdin(id string, data []byte) error {
+	streammsg := channel.StreamMessage{
+		ID:     id,
+		Stream: channel.STREAM_STDIN,
+		Data:   data}
+	if l.supports(channel.FEATURE_STDIN_ACK) != nil {
+		return l.ctlChannel.Send(0, channel.MSG_STDIN, streammsg)
+	}
+	reply, err := l.callWithin(nil, "Stdin", 0, channel.MSG_STDIN, streammsg)
+	if err != nil {
+		return err
+	}
+	ack, ok := reply.(*channel.AckMessage)
+	if !ok {
+		return fmt.Errorf("Stdin error: unexpected reply %T", reply)
+	}
+	if err := ackError(ack); err != nil {
+		return errors.New("Stdin error:" + err.Error())
+	}
+	return nil
+}
+
+// Stats asks the agent for the cgroup numbers of the container.
+func (l *libagent) Stats(cancel <-chan struct{}) (*channel.StatsMessage, error) {
+	if err := l.supports(channel.FEATURE_STATS); err != nil {
+		return nil, err
+	}
+	reply, err := l.call(cancel, "Stats", channel.MSG_GET_STATS, channel.GetStatsMessage{})
+	if err != nil {
+		return nil, err
+	}
+	switch reply := reply.(type) {
+	case *channel.StatsMessage:
+		return reply, nil
+	case *channel.AckMessage:
+		if err := ackError(reply); err != nil {
+			return nil, errors.New("Stats error:" + err.Error())
+		}
+	}
+	return nil, fmt.Errorf("Stats error: unexpected reply %T", reply)
+}
+
+// WaitExit blocks until the agent reports that the workload exited.
+func (l *libagent) WaitExit() (*channel.ContainerExitMessage, error) {
+	select {
+	case exitmsg := <-l.exitChan:
+		log.Info("Recv: MSG_CONTAINER_EXIT")
+		return exitmsg, nil
+	case <-l.stopped:
+	}
+	// the exit may have come right before the end of the connection
+	select {
+	case exitmsg := <-l.exitChan:
+		log.Info("Recv: MSG_CONTAINER_EXIT")
+		return exitmsg, nil
+	default:
+		return nil, l.connError()
+	}
+}
+
+// connected reports whether Init succeeded.
+func (l *libagent) connected() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.conn != nil
 }
 
-func (l *libagent) AddContainer(rootfs string, cmdArgs []string, env []string) error {
-	msg := channel.Message{Type: channel.MSG_ADD_CONTAINER,
-		Content: channel.AddContainerMessage{
-			Rootfs:  rootfs,
-			CmdArgs: cmdArgs,
-			Env:     env,
-		},
-	}
-	l.ctlChannel.SendMessage(msg)
-
-	        //receive ack
-        for {
-                msg := <-l.ctlChannel.GetInputMessageChan()
-                if msg.Type == channel.MSG_ACK {
-                        log.Info("Recv: MSG_ACK")
-                        ackmsg := channel.AckMessage{}
-                        b, _ := json.Marshal(msg.Content)
-                        json.Unmarshal(b, &ackmsg)
-                        if ackmsg.AckType == channel.ACK_OK {
-                                log.Info("Add container success")
-                                return nil
-                        } else {
-                                log.Errorf("Add container error: %s", ackmsg.AckMsg)
-                                return errors.New("Add container error:" + ackmsg.AckMsg)
-                        }       
-                }       
-        }
+// Stopped is closed once the connection ended and its last message was
+// dispatched.
+func (l *libagent) Stopped() <-chan struct{} {
+	return l.stopped
 }
 
+// Destroy closes the connection to the agent, the calls in flight fail.
 func (l *libagent) Destroy() error {
-	return l.conn.Close()
+	return l.ctlChannel.Close()
 }
@@ -0,0 +1,200 @@
+package gemini
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// BootStage is a step of the start of a container VM.
+type BootStage string
+
+const (
+	BootStageSpawn     BootStage = "vm spawn"
+	BootStageSocket    BootStage = "socket"
+	BootStageHello     BootStage = "agent hello"
+	BootStageNetwork   BootStage = "network config"
+	BootStageContainer BootStage = "container start"
+)
+
+// BootError is returned by Run when the VM does not get to run the workload.
+type BootError struct {
+	Stage BootStage
+	Err   error
+}
+
+func (e *BootError) Error() string {
+	return fmt.Sprintf("gemini: boot failed at %s: %s", e.Stage, e.Err)
+}
+
+var errBootTimeout = errors.New("boot deadline exceeded")
+
+const (
+	minBackoff = 10 * time.Millisecond
+	maxBackoff = 500 * time.Millisecond
+
+	adoptPollInterval = time.Second
+)
+
+// vmProcess waits for the VM process in the background, so that an early
+// exit is noticed while the VM boots.
+type vmProcess struct {
+	*os.Process
+	done  chan struct{}
+	state *os.ProcessState
+	err   error
+}
+
+func newVMProcess(p *os.Process) *vmProcess {
+	vp := &vmProcess{
+		Process: p,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		vp.state, vp.err = p.Wait()
+		close(vp.done)
+	}()
+	return vp
+}
+
+// adoptVMProcess watches the VM pid started by a previous daemon. It is not
+// a child of this one, so its exit is polled for.
+func adoptVMProcess(pid int) *vmProcess {
+	p, _ := os.FindProcess(pid)
+	vp := &vmProcess{
+		Process: p,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		for syscall.Kill(pid, 0) == nil {
+			time.Sleep(adoptPollInterval)
+		}
+		close(vp.done)
+	}()
+	return vp
+}
+
+// Wait blocks until the process exits.
+func (p *vmProcess) Wait() (*os.ProcessState, error) {
+	<-p.done
+	return p.state, p.err
+}
+
+// Done is closed once the process exited.
+func (p *vmProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+// exitedWithin reports whether vm exits before timeout.
+func exitedWithin(vm VM, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-vm.Done():
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// exitError returns the error reported for a VM that went away mid boot.
+func exitError(vm VM) error {
+	state, err := vm.Wait()
+	if err != nil {
+		return fmt.Errorf("VM exited: %s", err)
+	}
+	if state == nil {
+		return fmt.Errorf("VM exited")
+	}
+	return fmt.Errorf("VM exited: %s", state)
+}
+
+// booter runs the boot steps of a VM within an overall deadline.
+type booter struct {
+	vm       VM
+	deadline time.Time
+}
+
+// step runs fn and turns its failure, the boot deadline passing or the VM
+// exiting into a BootError for stage. cancel is closed when step returns.
+func (b *booter) step(stage BootStage, fn func(cancel <-chan struct{}) error) error {
+	_, err := b.stepConn(stage, func(cancel <-chan struct{}) (net.Conn, error) {
+		return nil, fn(cancel)
+	})
+	return err
+}
+
+type stepResult struct {
+	conn net.Conn
+	err  error
+}
+
+// stepConn is step for an fn opening a connection, handed to the caller. A
+// connection opened once step gave up has no owner, it is closed.
+func (b *booter) stepConn(stage BootStage, fn func(cancel <-chan struct{}) (net.Conn, error)) (net.Conn, error) {
+	cancel := make(chan struct{})
+	defer close(cancel)
+	result := make(chan stepResult, 1)
+	go func() {
+		conn, err := fn(cancel)
+		result <- stepResult{conn, err}
+	}()
+
+	timer := time.NewTimer(b.deadline.Sub(time.Now()))
+	defer timer.Stop()
+	var err error
+	select {
+	case res := <-result:
+		if res.err != nil {
+			return nil, &BootError{Stage: stage, Err: res.err}
+		}
+		return res.conn, nil
+	case <-b.vm.Done():
+		err = exitError(b.vm)
+	case <-timer.C:
+		err = errBootTimeout
+	}
+	go func() {
+		if res := <-result; res.conn != nil {
+			res.conn.Close()
+		}
+	}()
+	return nil, &BootError{Stage: stage, Err: err}
+}
+
+// retry calls fn with an exponential backoff until it succeeds or cancel is
+// closed.
+func retry(cancel <-chan struct{}, fn func() error) error {
+	backoff := minBackoff
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-cancel:
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// waitSocket waits for the hypervisor to create the unix socket at path.
+func waitSocket(cancel <-chan struct{}, path string) error {
+	return retry(cancel, func() error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s is not a socket", path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+package gemini
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// stubVM is a VM that never exits.
+type stubVM struct {
+	VM
+	done chan struct{}
+}
+
+func (vm *stubVM) Done() <-chan struct{} {
+	return vm.done
+}
+
+// TestStepLateConn checks that a connection opened once the step gave up is
+// closed rather than leaked.
+func TestStepLateConn(t *testing.T) {
+	boot := &booter{
+		vm:       &stubVM{done: make(chan struct{})},
+		deadline: time.Now().Add(50 * time.Millisecond),
+	}
+	a, b := net.Pipe()
+	defer b.Close()
+	release := make(chan struct{})
+	conn, err := boot.stepConn(BootStageSocket, func(cancel <-chan struct{}) (net.Conn, error) {
+		<-release
+		return a, nil
+	})
+	bootErr, ok := err.(*BootError)
+	if conn != nil || !ok || bootErr.Err != errBootTimeout {
+		t.Fatalf("step returned %v, %v, want a boot timeout", conn, err)
+	}
+
+	close(release)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %v from the late connection, want it closed", err)
+	}
+}
@@ -3,6 +3,8 @@ package gemini
 import (
 	"crypto/rand"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
@@ -10,6 +12,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/cvm/cvmagent/channel"
 
 	"github.com/docker/docker/daemon/execdriver"
 	sysinfo "github.com/docker/docker/pkg/system"
@@ -18,12 +21,24 @@ import (
 const (
 	DriverName = "gemini"
 	Version    = "0.1"
+
+	// how long Run waits for the exit status once the VM is gone
+	exitStatusTimeout = time.Second
 )
 
 type SafeContainer struct {
 	pid      int
+	vm       VM
+	config   *VMConfig
 	sockPath string
-	agent    libagent
+	agent    *libagent
+	network  *vmNetwork
+	res      *vmResources
+	// vCPUs stopped by Pause, guarded by the driver lock. pauseLock
+	// serializes the monitor commands changing it, which run outside of the
+	// driver lock so that a hung VM holds up its container only.
+	paused    bool
+	pauseLock sync.Mutex
 }
 
 type driver struct {
@@ -31,10 +46,38 @@ type driver struct {
 	initPath         string
 	activeContainers map[string]*SafeContainer
 	machineMemory    int64
+	options          *vmOptions
+	hypervisor       Hypervisor
+	capabilities     *Capabilities
+	// exit status of the reattached containers whose VM is gone, kept
+	// until Clean
+	exits map[string]execdriver.ExitStatus
+	// VMs restore found running but could not reach, left to the next
+	// daemon rather than to the GC
+	unreachable map[string]*containerState
 	sync.Mutex
+
+	// held for reading by Run until the resources it sets up are
+	// registered, for writing by CollectGarbage
+	gcLock sync.RWMutex
 }
 
 func NewDriver(root, initPath string, options []string) (*driver, error) {
+	opts, err := parseOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	hypervisor, err := newHypervisor(opts)
+	if err != nil {
+		return nil, err
+	}
+	capabilities, err := hypervisor.Probe()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("gemini: %s", capabilities)
+
 	meminfo, err := sysinfo.ReadMemInfo()
 	if err != nil {
 		return nil, err
@@ -44,12 +87,21 @@ func NewDriver(root, initPath string, options []string) (*driver, error) {
 		return nil, err
 	}
 
-	return &driver{
+	d := &driver{
 		root:             root,
 		initPath:         initPath,
 		activeContainers: make(map[string]*SafeContainer),
 		machineMemory:    meminfo.MemTotal,
-	}, nil
+		options:          opts,
+		hypervisor:       hypervisor,
+		capabilities:     capabilities,
+		exits:            make(map[string]execdriver.ExitStatus),
+		unreachable:      make(map[string]*containerState),
+	}
+	d.restore()
+	d.startupGC()
+	go d.gcOnSignal()
+	return d, nil
 }
 
 func RandomMAC() string {
@@ -63,98 +115,205 @@ func RandomMAC() string {
 
 func (d *driver) Run(c *execdriver.Command, pipes *execdriver.Pipes, startCallback execdriver.StartCallback) (execdriver.ExitStatus, error) {
 
-	command := "/usr/bin/qemu-system-x86_64"
 	mntdir := c.Rootfs[:len(c.Rootfs)-7]
-	kernel := "/home/gemini/vmlinux_4_0_4"
-	initrd := "/home/gemini/initramfs2.gz"
-	sock_path := "/tmp/" + c.ID + ".sock"
 
-	ip, netmask, qemuifup, err := GetIpaddrAndQemuUpScript(c.Network.NamespacePath)
+	res, err := d.vmResourcesFor(c.Resources)
 	if err != nil {
-		log.Error(err)
+		return execdriver.ExitStatus{ExitCode: -1}, err
+	}
+
+	d.gcLock.RLock()
+	gcLocked := true
+	defer func() {
+		if gcLocked {
+			d.gcLock.RUnlock()
+		}
+	}()
+
+	// without a network namespace the VM gets no network
+	var network *vmNetwork
+	if c.Network != nil && c.Network.NamespacePath != "" {
+		network, err = setupNetwork(c.Network.NamespacePath)
+		if err != nil {
+			log.Errorf("Network setup error: %s", err)
+			return execdriver.ExitStatus{ExitCode: -1}, &BootError{Stage: BootStageNetwork, Err: err}
+		}
 	}
 
-	attr := &os.ProcAttr{
-		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
-	}
-	p, err := os.StartProcess(command,
-		[]string{
-			command,
-			"-machine", "pc-i440fx-2.0,usb=off",
-			"-global", "kvm-pit.lost_tick_policy=discard",
-			"-serial", "pty", "-append", "\"console=ttyS0 panic=1\"",
-			"-realtime", "mlock=off", "-no-user-config",
-			"-nodefaults", "-no-hpet", "-rtc", "base=utc,driftfix=slew",
-			"-no-reboot",
-			"-display", "none",
-			"-boot", "strict=on", "-m", "128", "-smp", "1",
-			"-kernel", kernel,
-			"-initrd", initrd,
-			"-device", "virtio-serial-pci,id=virtio-serial0,bus=pci.0,addr=0x6",
-			"-chardev", "socket,id=charch0,path=" + sock_path + ",server,nowait",
-			"-device", "virtserialport,bus=virtio-serial0.0,nr=1,chardev=charch0,id=channel0,name=cvm.channel.0",
-			"-fsdev", "local,id=virtio9p,path=" + mntdir + ",security_model=none",
-			"-device", "virtio-9p-pci,fsdev=virtio9p,mount_tag=share_dir",
-			"-netdev", "type=tap,id=hostnet0,script=" + qemuifup, "-device", "virtio-net-pci,netdev=hostnet0",
-		},
-		attr)
+	if err := os.MkdirAll(filepath.Join(d.root, c.ID), 0700); err != nil {
+		releaseNetwork(c.ID, network)
+		return execdriver.ExitStatus{ExitCode: -1}, err
+	}
+	config := d.hypervisor.Config(c.ID, res, network, mntdir)
+	config.LogPath = filepath.Join(d.root, c.ID, d.hypervisor.Name()+".log")
+	vm, err := d.hypervisor.Launch(config)
 	if err != nil {
-		log.Error(err)
+		log.Errorf("Start %s error: %s", d.hypervisor.Name(), err)
+		os.Remove(config.AgentSocket)
+		releaseNetwork(c.ID, network)
+		return execdriver.ExitStatus{ExitCode: -1}, &BootError{Stage: BootStageSpawn, Err: err}
 	}
+	defer vm.Close()
 
 	d.Lock()
-	agent := libagent{
+	agent := &libagent{
 		protocol: "unix",
-		url:      sock_path,
+		url:      config.AgentSocket,
+		timeout:  d.options.agentTimeout,
 	}
-	d.activeContainers[c.ID] = &SafeContainer{pid: p.Pid,
-		sockPath: sock_path,
-		agent:    agent}
+	active := &SafeContainer{pid: vm.Pid(),
+		vm:       vm,
+		config:   config,
+		sockPath: config.AgentSocket,
+		agent:    agent,
+		network:  network,
+		res:      res}
+	d.activeContainers[c.ID] = active
+	delete(d.exits, c.ID)
+	delete(d.unreachable, c.ID)
 	d.Unlock()
+	d.gcLock.RUnlock()
+	gcLocked = false
+
+	// fail tears the VM down when it never got to run the workload, and
+	// releases what it holds on the host. The container directory stays for
+	// the hypervisor log, Clean removes it.
+	fail := func(err error) (execdriver.ExitStatus, error) {
+		log.Error(err)
+		vm.Kill()
+		vm.Wait()
+		d.Lock()
+		delete(d.activeContainers, c.ID)
+		d.Unlock()
+		d.release(c.ID, active)
+		return execdriver.ExitStatus{ExitCode: -1}, err
+	}
 
-	// FIXME: wait for sock
-	time.Sleep(time.Second * 2)
-	err = agent.Init()
+	// every step below is bounded by the boot deadline and given up as soon
+	// as the VM exits
+	boot := &booter{vm: vm, deadline: time.Now().Add(d.options.bootTimeout)}
+	conn, err := boot.stepConn(BootStageSocket, func(cancel <-chan struct{}) (net.Conn, error) {
+		if err := waitSocket(cancel, config.AgentSocket); err != nil {
+			return nil, err
+		}
+		var conn net.Conn
+		err := retry(cancel, func() (err error) {
+			conn, err = agent.Dial()
+			return err
+		})
+		return conn, err
+	})
 	if err != nil {
-		log.Errorf("Init error: %s", err)
-		return execdriver.ExitStatus{
-			ExitCode:  1,
-			OOMKilled: false}, nil
+		return fail(err)
+	}
+	if err := agent.Init(conn); err != nil {
+		return fail(&BootError{Stage: BootStageSocket, Err: err})
 	}
 
-	agent.IsReady()
+	err = boot.step(BootStageSocket, vm.Connect)
+	if err != nil {
+		return fail(err)
+	}
 
-	err = agent.SetIP("eth0", ip, netmask)
+	err = boot.step(BootStageHello, func(cancel <-chan struct{}) error {
+		return agent.IsReady(cancel)
+	})
 	if err != nil {
-		log.Errorf("Set ip error: %s", err)
-		return execdriver.ExitStatus{
-			ExitCode:  1,
-			OOMKilled: false}, nil
+		return fail(err)
 	}
 
-	err = agent.AddContainer("/cvmfs/rootfs",
-		append([]string{c.ProcessConfig.Entrypoint}, c.ProcessConfig.Arguments...),
-		c.ProcessConfig.Env)
+	if network != nil {
+		err = boot.step(BootStageNetwork, func(cancel <-chan struct{}) error {
+			return agent.SetIP(cancel, "eth0", network.ipaddr, network.netmask)
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	initProcess := &agentProcess{
+		stdout: pipes.Stdout,
+		stderr: pipes.Stderr,
+	}
+	err = boot.step(BootStageContainer, func(cancel <-chan struct{}) error {
+		if err := agent.Attach(channel.INIT_PROCESS_ID, initProcess); err != nil {
+			return err
+		}
+		return agent.AddContainer(cancel, "/cvmfs/rootfs",
+			append([]string{c.ProcessConfig.Entrypoint}, c.ProcessConfig.Arguments...),
+			c.ProcessConfig.Env,
+			res.memoryLimit,
+			res.memorySwap,
+			c.ProcessConfig.Tty)
+	})
 	if err != nil {
-		log.Errorf("Add container error: %s", err)
-		return execdriver.ExitStatus{
-			ExitCode:  1,
-			OOMKilled: false}, nil
+		return fail(err)
+	}
+
+	if err := d.saveState(c.ID, active); err != nil {
+		log.Errorf("Save state of %s error: %s", c.ID, err)
+	}
+
+	// with a tty the guest console output all comes as stdout
+	c.ProcessConfig.Terminal = &agentTerminal{process: initProcess}
+
+	if pipes.Stdin != nil {
+		go func() {
+			io.Copy(initProcess, pipes.Stdin)
+			initProcess.CloseStdin()
+		}()
+	} else {
+		initProcess.CloseStdin()
 	}
 
+	// the agent reports the workload exit status right before the guest
+	// powers off
+	exitChan := make(chan *channel.ContainerExitMessage, 1)
+	go func() {
+		exit, err := agent.WaitExit()
+		if err != nil {
+			log.Errorf("Wait container exit error: %s", err)
+			return
+		}
+		exitChan <- exit
+	}()
+
 	if startCallback != nil {
-		pid := p.Pid
-		startCallback(&c.ProcessConfig, pid)
+		startCallback(&c.ProcessConfig, vm.Pid())
+	}
+
+	state, err := vm.Wait()
+	if err != nil {
+		return execdriver.ExitStatus{ExitCode: -1}, err
+	}
+	select {
+	case exit := <-exitChan:
+		// the output came before the exit
+		initProcess.flush()
+		return exitStatus(exit), nil
+	case <-time.After(exitStatusTimeout):
+		return execdriver.ExitStatus{ExitCode: -1},
+			fmt.Errorf("%s exited (%s) without reporting the container exit status", d.hypervisor.Name(), state)
 	}
+}
 
-	p.Wait()
+// exitStatus is the docker exit status of the container exit reported by
+// the agent.
+func exitStatus(exit *channel.ContainerExitMessage) execdriver.ExitStatus {
+	exitCode := exit.ExitCode
+	if exit.Signal != 0 {
+		exitCode = 128 + exit.Signal
+	}
 	return execdriver.ExitStatus{
-		ExitCode:  0,
-		OOMKilled: false}, nil
+		ExitCode:  exitCode,
+		OOMKilled: exit.OOMKilled}
 }
 
 func (d *driver) Clean(id string) error {
-	return os.RemoveAll(filepath.Join(d.root, id))
+	d.Lock()
+	delete(d.exits, id)
+	d.Unlock()
+	return d.cleanContainer(id)
 }
 
 func (d *driver) GetPidsForContainer(id string) ([]int, error) {
@@ -168,6 +327,8 @@ func (d *driver) Info(id string) execdriver.Info {
 	}
 }
 
+// Kill sends sig to the workload inside the guest. SIGKILL falls back to
+// killing the VM when the agent does not answer.
 func (d *driver) Kill(c *execdriver.Command, sig int) error {
 	d.Lock()
 	active := d.activeContainers[c.ID]
@@ -175,21 +336,88 @@ func (d *driver) Kill(c *execdriver.Command, sig int) error {
 	if active == nil {
 		return fmt.Errorf("active container for %s does not exist", c.ID)
 	}
-	return syscall.Kill(active.pid, syscall.Signal(sig))
+	if d.isPaused(active) {
+		if syscall.Signal(sig) != syscall.SIGKILL {
+			return fmt.Errorf("container %s is paused, unpause it first", c.ID)
+		}
+		return active.vm.Kill()
+	}
+
+	// bounded by the agent call timeout
+	err := active.agent.Signal(nil, sig, false)
+	if err == nil {
+		return nil
+	}
+	if syscall.Signal(sig) != syscall.SIGKILL {
+		return fmt.Errorf("signal container %s: %s", c.ID, err)
+	}
+	log.Warnf("Signal container %s error: %s, killing the VM", c.ID, err)
+	return active.vm.Kill()
 }
 
 func (d *driver) Name() string {
 	return fmt.Sprintf("%s-%s", DriverName, Version)
 }
 
+// Capabilities returns what the driver found out about the host on start,
+// Name stays the same whatever the host.
+func (d *driver) Capabilities() *Capabilities {
+	return d.capabilities
+}
+
+// Pause stops the vCPUs of the VM, the guest keeps its state.
 func (d *driver) Pause(c *execdriver.Command) error {
+	d.Lock()
+	active := d.activeContainers[c.ID]
+	d.Unlock()
+	if active == nil {
+		return fmt.Errorf("container %s is not running", c.ID)
+	}
+	active.pauseLock.Lock()
+	defer active.pauseLock.Unlock()
+	if d.isPaused(active) {
+		return fmt.Errorf("container %s is already paused", c.ID)
+	}
+	if err := active.vm.Pause(); err != nil {
+		return fmt.Errorf("pause container %s: %s", c.ID, err)
+	}
+	d.setPaused(active, true)
 	return nil
 }
 
+// Unpause resumes the vCPUs stopped by Pause.
 func (d *driver) Unpause(c *execdriver.Command) error {
+	d.Lock()
+	active := d.activeContainers[c.ID]
+	d.Unlock()
+	if active == nil {
+		return fmt.Errorf("container %s is not running", c.ID)
+	}
+	active.pauseLock.Lock()
+	defer active.pauseLock.Unlock()
+	if !d.isPaused(active) {
+		return fmt.Errorf("container %s is not paused", c.ID)
+	}
+	if err := active.vm.Resume(); err != nil {
+		return fmt.Errorf("unpause container %s: %s", c.ID, err)
+	}
+	d.setPaused(active, false)
 	return nil
 }
 
+func (d *driver) isPaused(active *SafeContainer) bool {
+	d.Lock()
+	defer d.Unlock()
+	return active.paused
+}
+
+func (d *driver) setPaused(active *SafeContainer, paused bool) {
+	d.Lock()
+	active.paused = paused
+	d.Unlock()
+}
+
+// Terminate stops the VM in stages, see stopVM, and tears it down.
 func (d *driver) Terminate(c *execdriver.Command) error {
 	defer d.cleanContainer(c.ID)
 	d.Lock()
@@ -198,20 +426,56 @@ func (d *driver) Terminate(c *execdriver.Command) error {
 	if active == nil {
 		return fmt.Errorf("active container for %s does not exist", c.ID)
 	}
-	return syscall.Kill(active.pid, 9)
-}
-
-func (d *driver) Stats(id string) (*execdriver.ResourceStats, error) {
-	return nil, nil
-}
-
-func (d *driver) Exec(c *execdriver.Command, processConfig *execdriver.ProcessConfig, pipes *execdriver.Pipes, startCallbak execdriver.StartCallback) (int, error) {
-	return 0, nil
+	stage, err := d.stopVM(active)
+	if err != nil {
+		return fmt.Errorf("terminate container %s: %s", c.ID, err)
+	}
+	log.Infof("Container %s stopped by %s", c.ID, stage)
+	return nil
 }
 
+// cleanContainer releases everything the VM of container id holds on the
+// host: the agent and hypervisor connections, their sockets, the network and
+// the container directory.
 func (d *driver) cleanContainer(id string) error {
 	d.Lock()
+	active := d.activeContainers[id]
 	delete(d.activeContainers, id)
 	d.Unlock()
+
+	if active != nil {
+		d.release(id, active)
+	}
 	return os.RemoveAll(filepath.Join(d.root, id))
 }
+
+// release closes the agent and hypervisor connections of the VM of container
+// id, and removes its socket and network.
+func (d *driver) release(id string, active *SafeContainer) {
+	if active.agent.connected() {
+		// the connection to a VM gone ends on its own once its last
+		// messages, the exit status among them, are dispatched
+		select {
+		case <-active.vm.Done():
+			select {
+			case <-active.agent.Stopped():
+			case <-time.After(exitStatusTimeout):
+			}
+		default:
+		}
+		active.agent.Destroy()
+	}
+	active.vm.Close()
+	os.Remove(active.sockPath)
+	releaseNetwork(id, active.network)
+}
+
+// releaseNetwork tears down the network of container id, if it has one.
+func releaseNetwork(id string, network *vmNetwork) {
+	if network == nil {
+		return
+	}
+	if err := network.teardown(); err != nil {
+		log.Errorf("Tear down network of %s error: %s", id, err)
+	}
+}
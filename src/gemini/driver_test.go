@@ -0,0 +1,514 @@
+package gemini
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cvm/cvmagent/channel"
+	"github.com/docker/docker/daemon/execdriver"
+)
+
+// newFakeDriver returns a driver whose VMs are run by a fake hypervisor
+// following script, rooted in a temporary directory.
+func newFakeDriver(t *testing.T, script *fakeAgentScript, options ...string) *driver {
+	root, err := ioutil.TempDir("", "gemini-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return restartFakeDriver(t, root, script, options...)
+}
+
+// restartFakeDriver returns a driver over root, which restores what a
+// driver before it left there like a restarted daemon.
+func restartFakeDriver(t *testing.T, root string, script *fakeAgentScript, options ...string) *driver {
+	hypervisors["fake"] = func(o *vmOptions) Hypervisor { return newFakeHypervisor(o, script) }
+	defer delete(hypervisors, "fake")
+
+	d, err := NewDriver(root, "", append([]string{
+		"gemini.hypervisor=fake",
+		"gemini.gc=off",
+		"gemini.boottimeout=5s",
+		"gemini.stoptimeout=1s",
+		"gemini.powerdowntimeout=1s",
+	}, options...))
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return d
+}
+
+func fakeCommand(d *driver, id string) *execdriver.Command {
+	return &execdriver.Command{
+		ID:     strings.Repeat(id, 64/len(id)),
+		Rootfs: filepath.Join(d.root, "mnt", id, "rootfs"),
+		ProcessConfig: execdriver.ProcessConfig{
+			Entrypoint: "/bin/sh",
+			Arguments:  []string{"-c", "sleep 3600"},
+		},
+	}
+}
+
+type runResult struct {
+	status execdriver.ExitStatus
+	err    error
+}
+
+// startFake runs c in the background, and returns once the workload is
+// started or Run gave up.
+func startFake(t *testing.T, d *driver, c *execdriver.Command) <-chan runResult {
+	started := make(chan struct{})
+	done := make(chan runResult, 1)
+	go func() {
+		pipes := &execdriver.Pipes{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+		status, err := d.Run(c, pipes, func(*execdriver.ProcessConfig, int) {
+			close(started)
+		})
+		done <- runResult{status, err}
+	}()
+	select {
+	case <-started:
+	case res := <-done:
+		t.Fatalf("Run returned before the start: %+v, %v", res.status, res.err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not start the container")
+	}
+	return done
+}
+
+func waitRun(t *testing.T, done <-chan runResult) runResult {
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(10 * time.Second):
+	}
+	t.Fatal("Run did not return")
+	return runResult{}
+}
+
+// checkCleaned checks that nothing of container id is left on the host.
+func checkCleaned(t *testing.T, d *driver, id string) {
+	if d.Info(id).IsRunning() {
+		t.Errorf("container %s still running", id)
+	}
+	for _, path := range []string{filepath.Join(d.root, id), socketPath(id, "sock")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+}
+
+func TestRunKill(t *testing.T) {
+	d := newFakeDriver(t, defaultFakeAgentScript())
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "ab")
+
+	done := startFake(t, d, c)
+	if !d.Info(c.ID).IsRunning() {
+		t.Fatal("container not running after the start")
+	}
+	if err := d.Kill(c, int(syscall.SIGTERM)); err != nil {
+		t.Fatal(err)
+	}
+	res := waitRun(t, done)
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.status.ExitCode != 143 || res.status.OOMKilled {
+		t.Fatalf("exit status %+v, want exit code 143", res.status)
+	}
+
+	if err := d.Clean(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkCleaned(t, d, c.ID)
+}
+
+func TestTerminate(t *testing.T) {
+	d := newFakeDriver(t, defaultFakeAgentScript())
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "cd")
+
+	done := startFake(t, d, c)
+	if err := d.Terminate(c); err != nil {
+		t.Fatal(err)
+	}
+	res := waitRun(t, done)
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if res.status.ExitCode != 143 {
+		t.Fatalf("exit status %+v, want exit code 143", res.status)
+	}
+	checkCleaned(t, d, c.ID)
+}
+
+// TestTerminateHungAgent checks that a VM whose agent ignores the stop is
+// powered down.
+func TestTerminateHungAgent(t *testing.T) {
+	script := defaultFakeAgentScript()
+	script.On[channel.MSG_STOP_CONTAINER] = fakeAction{}
+	d := newFakeDriver(t, script)
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "ef")
+
+	done := startFake(t, d, c)
+	if err := d.Terminate(c); err != nil {
+		t.Fatal(err)
+	}
+	// the guest went down without the agent reporting the exit status
+	if res := waitRun(t, done); res.err == nil {
+		t.Fatalf("exit status %+v, want an error", res.status)
+	}
+	checkCleaned(t, d, c.ID)
+}
+
+func TestBootTimeout(t *testing.T) {
+	d := newFakeDriver(t, &fakeAgentScript{NoReady: true}, "gemini.boottimeout=300ms")
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "01")
+
+	pipes := &execdriver.Pipes{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	_, err := d.Run(c, pipes, func(*execdriver.ProcessConfig, int) {
+		t.Error("start callback called on a failed boot")
+	})
+	bootErr, ok := err.(*BootError)
+	if !ok {
+		t.Fatalf("Run error %v, want a BootError", err)
+	}
+	if bootErr.Stage != BootStageHello {
+		t.Errorf("boot failed at %s, want %s", bootErr.Stage, BootStageHello)
+	}
+	if d.Info(c.ID).IsRunning() {
+		t.Error("container running after a failed boot")
+	}
+	if _, err := os.Stat(socketPath(c.ID, "sock")); !os.IsNotExist(err) {
+		t.Errorf("agent socket left behind: %v", err)
+	}
+
+	// the container directory stays for the hypervisor log until Clean
+	if _, err := os.Stat(filepath.Join(d.root, c.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Clean(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkCleaned(t, d, c.ID)
+}
+
+func TestLegacyAgent(t *testing.T) {
+	d := newFakeDriver(t, &fakeAgentScript{Legacy: true})
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "02")
+
+	pipes := &execdriver.Pipes{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	_, err := d.Run(c, pipes, nil)
+	bootErr, ok := err.(*BootError)
+	if !ok {
+		t.Fatalf("Run error %v, want a BootError", err)
+	}
+	if bootErr.Stage != BootStageHello || !strings.Contains(bootErr.Error(), "update the initramfs") {
+		t.Errorf("boot error %q at %s, want the agent too old at %s", bootErr, bootErr.Stage, BootStageHello)
+	}
+	if err := d.Clean(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkCleaned(t, d, c.ID)
+}
+
+// fakeAgentOf returns the fake agent of the VM of container id.
+func fakeAgentOf(t *testing.T, d *driver, id string) *fakeAgent {
+	d.Lock()
+	active := d.activeContainers[id]
+	d.Unlock()
+	if active == nil {
+		t.Fatalf("container %s not running", id)
+	}
+	return active.vm.(*fakeVM).agent
+}
+
+// runBootError runs c on d, and checks that the boot fails at stage with an
+// error holding want.
+func runBootError(t *testing.T, d *driver, c *execdriver.Command, stage BootStage, want string) *BootError {
+	pipes := &execdriver.Pipes{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	_, err := d.Run(c, pipes, func(*execdriver.ProcessConfig, int) {
+		t.Error("start callback called on a failed boot")
+	})
+	bootErr, ok := err.(*BootError)
+	if !ok {
+		t.Fatalf("Run error %v, want a BootError", err)
+	}
+	if bootErr.Stage != stage || !strings.Contains(bootErr.Error(), want) {
+		t.Errorf("boot error %q at %s, want %q at %s", bootErr, bootErr.Stage, want, stage)
+	}
+	if err := d.Clean(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkCleaned(t, d, c.ID)
+	return bootErr
+}
+
+func TestAddContainerError(t *testing.T) {
+	script := defaultFakeAgentScript()
+	script.On[channel.MSG_ADD_CONTAINER] = fakeAction{Messages: []channel.Message{fakeAck("rootfs not found")}}
+	d := newFakeDriver(t, script)
+	defer os.RemoveAll(d.root)
+
+	runBootError(t, d, fakeCommand(d, "03"), BootStageContainer, "rootfs not found")
+}
+
+func TestAgentCallTimeout(t *testing.T) {
+	script := defaultFakeAgentScript()
+	script.On[channel.MSG_ADD_CONTAINER] = fakeAction{
+		Delay:    2 * time.Second,
+		Messages: []channel.Message{fakeAck("")},
+	}
+	d := newFakeDriver(t, script, "gemini.agenttimeout=200ms")
+	defer os.RemoveAll(d.root)
+
+	bootErr := runBootError(t, d, fakeCommand(d, "04"), BootStageContainer, "200ms")
+	if _, ok := bootErr.Err.(*AgentTimeoutError); !ok {
+		t.Errorf("boot error %v, want an AgentTimeoutError", bootErr.Err)
+	}
+}
+
+func TestHelloVersionMismatch(t *testing.T) {
+	d := newFakeDriver(t, &fakeAgentScript{Hello: &channel.HelloMessage{
+		Version:    channel.PROTOCOL_VERSION + 2,
+		MinVersion: channel.PROTOCOL_VERSION + 1,
+		Features:   channel.Features,
+		Codecs:     []string{channel.CODEC_JSON},
+	}})
+	defer os.RemoveAll(d.root)
+
+	runBootError(t, d, fakeCommand(d, "05"), BootStageHello, "Hello error")
+}
+
+// TestHelloFeatureMismatch checks that an agent without a feature boots, and
+// that the calls needing the feature fail.
+func TestHelloFeatureMismatch(t *testing.T) {
+	script := defaultFakeAgentScript()
+	hello := channel.NewHello()
+	hello.Features = []string{channel.FEATURE_STOP, channel.FEATURE_SIGNAL}
+	script.Hello = &hello
+	d := newFakeDriver(t, script)
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "06")
+
+	done := startFake(t, d, c)
+	pipes := &execdriver.Pipes{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	_, err := d.Exec(c, &execdriver.ProcessConfig{Entrypoint: "/bin/true"}, pipes, nil)
+	if err == nil || !strings.Contains(err.Error(), "does not support "+channel.FEATURE_EXEC) {
+		t.Errorf("Exec error %v, want the exec feature missing", err)
+	}
+	if _, err := d.Stats(c.ID); err != nil {
+		t.Errorf("Stats error %v, want the stats of the VM alone", err)
+	}
+
+	if err := d.Terminate(c); err != nil {
+		t.Fatal(err)
+	}
+	waitRun(t, done)
+	checkCleaned(t, d, c.ID)
+}
+
+func TestPauseKill(t *testing.T) {
+	d := newFakeDriver(t, defaultFakeAgentScript())
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "07")
+
+	done := startFake(t, d, c)
+	if err := d.Unpause(c); err == nil {
+		t.Error("Unpause of a running container succeeded")
+	}
+	if err := d.Pause(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Pause(c); err == nil {
+		t.Error("Pause of a paused container succeeded")
+	}
+	if paused, _ := fakeAgentOf(t, d, c.ID).vm.Paused(); !paused {
+		t.Error("VM running after Pause")
+	}
+	if err := d.Unpause(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Pause(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// the guest of a paused VM cannot take a signal, only SIGKILL goes
+	if err := d.Kill(c, int(syscall.SIGTERM)); err == nil || !strings.Contains(err.Error(), "paused") {
+		t.Errorf("SIGTERM of a paused container: error %v", err)
+	}
+	pipes := &execdriver.Pipes{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+	if _, err := d.Exec(c, &execdriver.ProcessConfig{Entrypoint: "/bin/true"}, pipes, nil); err == nil {
+		t.Error("Exec in a paused container succeeded")
+	}
+	if err := d.Kill(c, int(syscall.SIGKILL)); err != nil {
+		t.Fatal(err)
+	}
+	// the VM went down with no exit status from the agent
+	if res := waitRun(t, done); res.err == nil {
+		t.Errorf("exit status %+v, want an error", res.status)
+	}
+	if err := d.Clean(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	checkCleaned(t, d, c.ID)
+}
+
+func TestExec(t *testing.T) {
+	execs := make(chan string, 2)
+	script := defaultFakeAgentScript()
+	script.OnExec = func(exec *channel.ExecMessage) fakeAction {
+		execs <- exec.ID
+		exit := fakeExecExit(exec.ID, 3, 0)
+		if exec.CmdArgs[0] == "kill" {
+			exit = fakeExecExit(exec.ID, 0, int(syscall.SIGKILL))
+		}
+		return fakeAction{Messages: []channel.Message{
+			fakeAck(""),
+			fakeOutput(exec.ID, channel.STREAM_STDOUT, "out "+strings.Join(exec.CmdArgs, " ")),
+			fakeOutput(exec.ID, channel.STREAM_STDERR, "err"),
+			exit,
+		}}
+	}
+	d := newFakeDriver(t, script)
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "08")
+	done := startFake(t, d, c)
+
+	for _, tc := range []struct {
+		entrypoint string
+		exitCode   int
+	}{
+		{"ls", 3},
+		{"kill", 128 + int(syscall.SIGKILL)},
+	} {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		pipes := &execdriver.Pipes{
+			Stdin:  ioutil.NopCloser(strings.NewReader("input")),
+			Stdout: stdout,
+			Stderr: stderr,
+		}
+		config := &execdriver.ProcessConfig{Entrypoint: tc.entrypoint, Arguments: []string{"-l"}}
+		exitCode, err := d.Exec(c, config, pipes, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exitCode != tc.exitCode {
+			t.Errorf("%s: exit code %d, want %d", tc.entrypoint, exitCode, tc.exitCode)
+		}
+		if stdout.String() != "out "+tc.entrypoint+" -l" || stderr.String() != "err" {
+			t.Errorf("%s: stdout %q, stderr %q", tc.entrypoint, stdout, stderr)
+		}
+
+		// the stdin goes on being copied once the process exited
+		id := <-execs
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stdin, closed := fakeAgentOf(t, d, c.ID).recordedStdin(id)
+			if closed {
+				if stdin != "input" {
+					t.Errorf("%s: stdin %q, want %q", tc.entrypoint, stdin, "input")
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: stdin %q not closed", tc.entrypoint, stdin)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := d.Terminate(c); err != nil {
+		t.Fatal(err)
+	}
+	waitRun(t, done)
+}
+
+// blockedWriter blocks the writes until release is closed, writing gets a
+// value once one is blocked.
+type blockedWriter struct {
+	release chan struct{}
+	writing chan struct{}
+	bytes.Buffer
+}
+
+func (w *blockedWriter) Write(b []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return w.Buffer.Write(b)
+}
+
+// TestExecSlowClient checks that a client not reading the output of its
+// process holds up no other call to the agent.
+func TestExecSlowClient(t *testing.T) {
+	script := defaultFakeAgentScript()
+	script.OnExec = func(exec *channel.ExecMessage) fakeAction {
+		return fakeAction{Messages: []channel.Message{
+			fakeAck(""),
+			fakeOutput(exec.ID, channel.STREAM_STDOUT, "a"),
+			fakeOutput(exec.ID, channel.STREAM_STDOUT, "b"),
+			fakeExecExit(exec.ID, 0, 0),
+		}}
+	}
+	d := newFakeDriver(t, script, "gemini.agenttimeout=1s")
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "09")
+	done := startFake(t, d, c)
+
+	stdout := &blockedWriter{release: make(chan struct{}), writing: make(chan struct{}, 1)}
+	exited := make(chan error, 1)
+	go func() {
+		pipes := &execdriver.Pipes{Stdout: stdout, Stderr: &bytes.Buffer{}}
+		_, err := d.Exec(c, &execdriver.ProcessConfig{Entrypoint: "yes"}, pipes, nil)
+		exited <- err
+	}()
+
+	select {
+	case <-stdout.writing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output written")
+	}
+	// answered while the output waits for the client
+	d.Lock()
+	agent := d.activeContainers[c.ID].agent
+	d.Unlock()
+	if _, err := agent.Stats(nil); err != nil {
+		t.Fatalf("Stats while the client is blocked: %s", err)
+	}
+	select {
+	case err := <-exited:
+		t.Fatalf("Exec returned %v before its output was written", err)
+	default:
+	}
+
+	close(stdout.release)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exec did not return")
+	}
+	if stdout.String() != "ab" {
+		t.Errorf("stdout %q, want %q", stdout.String(), "ab")
+	}
+
+	if err := d.Terminate(c); err != nil {
+		t.Fatal(err)
+	}
+	waitRun(t, done)
+}
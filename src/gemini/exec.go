@@ -0,0 +1,256 @@
+package gemini
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cvm/cvmagent/channel"
+	"github.com/docker/docker/daemon/execdriver"
+)
+
+// agentProcess is a process started inside the guest by the agent. Its
+// output streams back over the agent channel, into a queue its own goroutine
+// writes to stdout and stderr, so that a slow client never holds up the
+// other messages of the agent.
+type agentProcess struct {
+	id       string
+	agent    *libagent
+	stdout   io.Writer
+	stderr   io.Writer
+	exitChan chan *channel.ExecExitMessage
+
+	// output not written yet, its size in bytes, and whether a chunk of it
+	// is being written
+	sync.Mutex
+	cond    *sync.Cond
+	queue   []*channel.StreamMessage
+	queued  int
+	writing bool
+	// set once no more output comes, with the exit of the process unless the
+	// connection ended first
+	ended bool
+	exit  *channel.ExecExitMessage
+}
+
+// start starts the output goroutine of the process.
+func (p *agentProcess) start() {
+	p.cond = sync.NewCond(&p.Mutex)
+	p.exitChan = make(chan *channel.ExecExitMessage, 1)
+	go p.writeOutput()
+}
+
+// output queues msg for the output goroutine. An agent with
+// FEATURE_OUTPUT_ACK sends no more than channel.OUTPUT_WINDOW bytes the
+// process did not ack, which bounds the queue. Other agents are held up here
+// while the queue is full.
+func (p *agentProcess) output(msg *channel.StreamMessage) {
+	if len(msg.Data) == 0 {
+		return
+	}
+	acked := p.agent.supports(channel.FEATURE_OUTPUT_ACK) == nil
+	p.Lock()
+	defer p.Unlock()
+	for !acked && p.queued >= channel.OUTPUT_WINDOW && !p.ended {
+		p.cond.Wait()
+	}
+	if p.ended {
+		return
+	}
+	p.queue = append(p.queue, msg)
+	p.queued += len(msg.Data)
+	p.cond.Broadcast()
+}
+
+// end tells the output goroutine that no more output comes. It hands exit to
+// Wait once it wrote the output queued, a nil exit tells Wait the connection
+// ended.
+func (p *agentProcess) end(exit *channel.ExecExitMessage) {
+	p.Lock()
+	defer p.Unlock()
+	if p.ended {
+		return
+	}
+	p.ended = true
+	p.exit = exit
+	p.cond.Broadcast()
+}
+
+// flush waits until the output queued so far is written.
+func (p *agentProcess) flush() {
+	p.Lock()
+	defer p.Unlock()
+	for len(p.queue) > 0 || p.writing {
+		p.cond.Wait()
+	}
+}
+
+func (p *agentProcess) writeOutput() {
+	for {
+		p.Lock()
+		for len(p.queue) == 0 && !p.ended {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			exit := p.exit
+			p.Unlock()
+			if exit != nil {
+				p.exitChan <- exit
+			}
+			close(p.exitChan)
+			return
+		}
+		msg := p.queue[0]
+		p.queue = p.queue[1:]
+		p.writing = true
+		p.Unlock()
+
+		p.write(msg)
+
+		p.Lock()
+		p.queued -= len(msg.Data)
+		p.writing = false
+		p.cond.Broadcast()
+		p.Unlock()
+	}
+}
+
+// write writes msg to the client and acks it, whether the client took it or
+// not: the agent must not wait for a client gone.
+func (p *agentProcess) write(msg *channel.StreamMessage) {
+	var w io.Writer
+	switch msg.Stream {
+	case channel.STREAM_STDOUT:
+		w = p.stdout
+	case channel.STREAM_STDERR:
+		w = p.stderr
+	}
+	if w != nil {
+		if _, err := w.Write(msg.Data); err != nil {
+			log.Errorf("Write output of %s error: %s", p.id, err)
+		}
+	}
+	if p.agent.supports(channel.FEATURE_OUTPUT_ACK) != nil {
+		return
+	}
+	err := p.agent.ctlChannel.Send(0, channel.MSG_OUTPUT_ACK,
+		channel.OutputAckMessage{
+			ID:    p.id,
+			Bytes: len(msg.Data)})
+	if err != nil {
+		log.Warnf("Ack output of %s error: %s", p.id, err)
+	}
+}
+
+// Write sends b to the stdin of the process, it blocks while the guest has
+// no room for it.
+func (p *agentProcess) Write(b []byte) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	if err := p.agent.Stdin(p.id, data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseStdin closes the stdin of the process.
+func (p *agentProcess) CloseStdin() {
+	err := p.agent.ctlChannel.Send(0, channel.MSG_STDIN,
+		channel.StreamMessage{
+			ID:     p.id,
+			Stream: channel.STREAM_STDIN,
+			Closed: true})
+	if err != nil {
+		log.Errorf("Close stdin of %s error: %s", p.id, err)
+	}
+}
+
+// Wait blocks until the process exits and its output is written, and returns
+// its exit code.
+func (p *agentProcess) Wait() (int, error) {
+	exit, ok := <-p.exitChan
+	if !ok {
+		return -1, p.agent.connError()
+	}
+	if exit.Signal != 0 {
+		return 128 + exit.Signal, nil
+	}
+	return exit.ExitCode, nil
+}
+
+// agentTerminal is the execdriver.Terminal of a process run by the agent.
+type agentTerminal struct {
+	process *agentProcess
+}
+
+func (t *agentTerminal) Resize(h, w int) error {
+	p := t.process
+	return p.agent.ctlChannel.Send(0, channel.MSG_WINDOW_SIZE,
+		channel.WindowSizeMessage{
+			ID:     p.id,
+			Height: uint16(h),
+			Width:  uint16(w)})
+}
+
+func (t *agentTerminal) Close() error {
+	return nil
+}
+
+func newExecID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Error(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (d *driver) Exec(c *execdriver.Command, processConfig *execdriver.ProcessConfig, pipes *execdriver.Pipes, startCallback execdriver.StartCallback) (int, error) {
+	d.Lock()
+	active := d.activeContainers[c.ID]
+	d.Unlock()
+	if active == nil {
+		return -1, fmt.Errorf("active container for %s does not exist", c.ID)
+	}
+	if d.isPaused(active) {
+		return -1, fmt.Errorf("container %s is paused, unpause it first", c.ID)
+	}
+
+	env := processConfig.Env
+	if len(env) == 0 {
+		env = c.ProcessConfig.Env
+	}
+	p := &agentProcess{
+		stdout: pipes.Stdout,
+		stderr: pipes.Stderr,
+	}
+	err := active.agent.Exec(nil, channel.ExecMessage{
+		ID:      newExecID(),
+		CmdArgs: append([]string{processConfig.Entrypoint}, processConfig.Arguments...),
+		Env:     env,
+		User:    processConfig.User,
+		WorkDir: c.WorkingDir,
+		Tty:     processConfig.Tty,
+	}, p)
+	if err != nil {
+		return -1, err
+	}
+	processConfig.Terminal = &agentTerminal{process: p}
+
+	if pipes.Stdin != nil {
+		go func() {
+			io.Copy(p, pipes.Stdin)
+			p.CloseStdin()
+		}()
+	} else {
+		p.CloseStdin()
+	}
+
+	if startCallback != nil {
+		startCallback(processConfig, active.pid)
+	}
+
+	return p.Wait()
+}
@@ -0,0 +1,452 @@
+package gemini
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cvm/cvmagent/channel"
+	"github.com/cvm/cvmagent/server"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+)
+
+// fakeHypervisor stands in for a real one so that the driver lifecycle runs
+// without root, KVM, a guest kernel or cvmagent: each VM is a helper process
+// doing nothing, and its agent socket is served in process by a fakeAgent
+// following script. The tests register it as the "fake" hypervisor, see
+// newFakeDriver.
+type fakeHypervisor struct {
+	options *vmOptions
+	script  *fakeAgentScript
+}
+
+// fakeVMs are the fake VMs running by pid, whichever driver launched them:
+// a second driver over the same root reattaches them like a restarted daemon.
+var fakeVMs = struct {
+	vms map[int]*fakeVM
+	sync.Mutex
+}{vms: make(map[int]*fakeVM)}
+
+func newFakeHypervisor(options *vmOptions, script *fakeAgentScript) Hypervisor {
+	return &fakeHypervisor{
+		options: options,
+		script:  script,
+	}
+}
+
+func (h *fakeHypervisor) Name() string {
+	return "fake"
+}
+
+func (h *fakeHypervisor) Probe() (*Capabilities, error) {
+	return &Capabilities{Hypervisor: h.Name(), Version: Version}, nil
+}
+
+func (h *fakeHypervisor) Config(id string, res *vmResources, network *vmNetwork, sharedDir string) *VMConfig {
+	config := &VMConfig{
+		ID:          id,
+		Memory:      res.memory,
+		Cpus:        res.cpus,
+		Cpuset:      res.cpuset,
+		Kernel:      h.options.kernel,
+		Initrd:      h.options.initrd,
+		Append:      h.options.append,
+		SharedDir:   sharedDir,
+		AgentSocket: socketPath(id, "sock"),
+	}
+	if network != nil {
+		config.TapScript = network.ifupScript
+	}
+	return config
+}
+
+func (h *fakeHypervisor) Launch(config *VMConfig) (VM, error) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(config.AgentSocket)
+	l, err := net.Listen("unix", config.AgentSocket)
+	if err != nil {
+		return nil, err
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	defer devNull.Close()
+	p, err := os.StartProcess(sleep, []string{sleep, "2147483647"}, &os.ProcAttr{
+		Files: []*os.File{devNull, devNull, devNull},
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	vm := &fakeVM{
+		vmProcess: newVMProcess(p),
+		config:    config,
+		devices:   make(map[string]map[string]interface{}),
+	}
+	vm.agent = &fakeAgent{listener: l, script: h.script, vm: vm}
+	go vm.agent.serve()
+
+	fakeVMs.Lock()
+	fakeVMs.vms[p.Pid] = vm
+	fakeVMs.Unlock()
+	go func() {
+		vm.Wait()
+		fakeVMs.Lock()
+		delete(fakeVMs.vms, p.Pid)
+		fakeVMs.Unlock()
+	}()
+	return vm, nil
+}
+
+func (h *fakeHypervisor) Reattach(config *VMConfig, pid int, startTime uint64) (VM, error) {
+	fakeVMs.Lock()
+	defer fakeVMs.Unlock()
+	vm := fakeVMs.vms[pid]
+	if vm == nil || vm.config.ID != config.ID {
+		return nil, fmt.Errorf("fake VM %d of %s is not running", pid, config.ID)
+	}
+	return vm, nil
+}
+
+func (h *fakeHypervisor) VMs() (map[int]string, error) {
+	fakeVMs.Lock()
+	defer fakeVMs.Unlock()
+	vms := make(map[int]string, len(fakeVMs.vms))
+	for pid, vm := range fakeVMs.vms {
+		vms[pid] = vm.config.ID
+	}
+	return vms, nil
+}
+
+// fakeVM is the helper process of a fake VM. Pausing stops it, powering it
+// down makes it exit.
+type fakeVM struct {
+	*vmProcess
+	config *VMConfig
+	agent  *fakeAgent
+
+	paused  bool
+	devices map[string]map[string]interface{}
+	sync.Mutex
+}
+
+func (vm *fakeVM) Pid() int {
+	return vm.Process.Pid
+}
+
+func (vm *fakeVM) Connect(cancel <-chan struct{}) error {
+	return nil
+}
+
+func (vm *fakeVM) Kill() error {
+	return vm.Process.Kill()
+}
+
+func (vm *fakeVM) Powerdown() error {
+	return vm.Process.Signal(syscall.SIGTERM)
+}
+
+func (vm *fakeVM) Pause() error {
+	vm.Lock()
+	defer vm.Unlock()
+	if err := vm.Process.Signal(syscall.SIGSTOP); err != nil {
+		return err
+	}
+	vm.paused = true
+	return nil
+}
+
+func (vm *fakeVM) Resume() error {
+	vm.Lock()
+	defer vm.Unlock()
+	if err := vm.Process.Signal(syscall.SIGCONT); err != nil {
+		return err
+	}
+	vm.paused = false
+	return nil
+}
+
+func (vm *fakeVM) Paused() (bool, error) {
+	vm.Lock()
+	defer vm.Unlock()
+	return vm.paused, nil
+}
+
+func (vm *fakeVM) Stats(stats *cgroups.Stats) error {
+	rss, err := qemuRss(vm.Pid())
+	if err != nil {
+		return err
+	}
+	stats.MemoryStats.Usage.Usage = rss
+	return qemuCpuStats(vm.Pid(), &stats.CpuStats)
+}
+
+func (vm *fakeVM) Hotplug(id string, args map[string]interface{}) error {
+	vm.Lock()
+	defer vm.Unlock()
+	if _, ok := vm.devices[id]; ok {
+		return fmt.Errorf("device %s already exists", id)
+	}
+	vm.devices[id] = args
+	return nil
+}
+
+func (vm *fakeVM) Unplug(id string) error {
+	vm.Lock()
+	defer vm.Unlock()
+	if _, ok := vm.devices[id]; !ok {
+		return fmt.Errorf("device %s not found", id)
+	}
+	delete(vm.devices, id)
+	return nil
+}
+
+func (vm *fakeVM) Close() error {
+	return vm.agent.close()
+}
+
+// fakeAction is what the fake agent does on a message of the daemon.
+type fakeAction struct {
+	// wait before answering
+	Delay time.Duration
+	// sent in order
+	Messages []channel.Message
+	// then the guest powers off
+	PowerOff bool
+}
+
+// fakeAgentScript drives a fake agent, it is read when the daemon connects.
+type fakeAgentScript struct {
+	// no MSG_AGENT_HELLO is sent when set, the boot never completes
+	NoReady    bool
+	ReadyDelay time.Duration
+	// the agent speaks the unframed JSON of the agents before the hello
+	// exchange, and nothing else
+	Legacy bool
+
+	// On gives the action for a message type of the daemon, an action with
+	// no messages leaves the request unanswered. A message type with no
+	// entry gets an ACK_ERROR, but for MSG_HELLO answered with Hello.
+	On map[int]fakeAction
+
+	// Hello is advertised by the agent, the current protocol when nil.
+	Hello *channel.HelloMessage
+
+	// OnSignal gives the action for a MSG_SIGNAL by signal number, the
+	// signals with no entry are acked.
+	OnSignal map[int]fakeAction
+
+	// OnExec gives the action for a MSG_EXEC from the exec it asks for, in
+	// place of On[MSG_EXEC] when set.
+	OnExec func(exec *channel.ExecMessage) fakeAction
+}
+
+// defaultFakeAgentScript behaves like cvmagent with a workload that runs
+// until it gets a signal.
+func defaultFakeAgentScript() *fakeAgentScript {
+	killed := func(sig syscall.Signal) fakeAction {
+		return fakeAction{
+			Messages: []channel.Message{fakeAck(""), fakeContainerExit(0, int(sig))},
+			PowerOff: true,
+		}
+	}
+	return &fakeAgentScript{
+		On: map[int]fakeAction{
+			channel.MSG_ADD_CONTAINER:  {Messages: []channel.Message{fakeAck("")}},
+			channel.MSG_SET_IP:         {Messages: []channel.Message{fakeAck("")}},
+			channel.MSG_EXEC:           {Messages: []channel.Message{fakeAck("")}},
+			channel.MSG_GET_STATS:      {Messages: []channel.Message{fakeMessage(channel.MSG_STATS, channel.StatsMessage{})}},
+			channel.MSG_STOP_CONTAINER: killed(syscall.SIGTERM),
+		},
+		OnSignal: map[int]fakeAction{
+			int(syscall.SIGTERM): killed(syscall.SIGTERM),
+			int(syscall.SIGKILL): killed(syscall.SIGKILL),
+			int(syscall.SIGINT):  killed(syscall.SIGINT),
+		},
+	}
+}
+
+func (s *fakeAgentScript) hello() channel.HelloMessage {
+	if s.Hello != nil {
+		return *s.Hello
+	}
+	return channel.NewHello()
+}
+
+// fakeMessage is the message of type msgType carrying content, it panics on
+// a content that is not the one of msgType.
+func fakeMessage(msgType int, content interface{}) channel.Message {
+	msg, err := channel.NewMessage(0, msgType, content)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// fakeAck is an ACK_OK, or an ACK_ERROR when errMsg is set.
+func fakeAck(errMsg string) channel.Message {
+	ack := channel.AckMessage{AckType: channel.ACK_OK}
+	if errMsg != "" {
+		ack = channel.AckMessage{AckType: channel.ACK_ERROR, AckMsg: errMsg}
+	}
+	return fakeMessage(channel.MSG_ACK, ack)
+}
+
+func fakeContainerExit(exitCode, signal int) channel.Message {
+	return fakeMessage(channel.MSG_CONTAINER_EXIT,
+		channel.ContainerExitMessage{
+			ExitCode: exitCode,
+			Signal:   signal})
+}
+
+func fakeOutput(id string, stream int, data string) channel.Message {
+	return fakeMessage(channel.MSG_OUTPUT,
+		channel.StreamMessage{
+			ID:     id,
+			Stream: stream,
+			Data:   []byte(data)})
+}
+
+func fakeExecExit(id string, exitCode, signal int) channel.Message {
+	return fakeMessage(channel.MSG_EXEC_EXIT,
+		channel.ExecExitMessage{
+			ID:       id,
+			ExitCode: exitCode,
+			Signal:   signal})
+}
+
+// fakeAgent speaks the agent protocol on the agent socket of a fake VM.
+type fakeAgent struct {
+	listener net.Listener
+	script   *fakeAgentScript
+	vm       *fakeVM
+
+	// the stdin of each process, set once it is closed
+	stdin       map[string][]byte
+	stdinClosed map[string]bool
+	sync.Mutex
+}
+
+func (a *fakeAgent) serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *fakeAgent) handle(conn net.Conn) {
+	if a.script.Legacy {
+		defer conn.Close()
+		conn.Write([]byte(`{"Type":0,"Content":{"Name":"cvmagent"}}` + "\n"))
+		<-a.vm.Done()
+		return
+	}
+	ctlChannel := &channel.MessageChannel{}
+	if err := ctlChannel.Init(conn, conn); err != nil {
+		conn.Close()
+		log.Errorf("Fake agent init error: %s", err)
+		return
+	}
+	defer ctlChannel.Close()
+	go func() {
+		select {
+		case <-a.vm.Done():
+			ctlChannel.Close()
+		case <-ctlChannel.Done():
+		}
+	}()
+
+	srv := server.New(ctlChannel, a.script.hello())
+	for msgType, action := range a.script.On {
+		srv.Handle(msgType, a.play(ctlChannel, action))
+	}
+	srv.Handle(channel.MSG_SIGNAL, func(req *server.Request) {
+		signalmsg := req.Payload.(*channel.SignalMessage)
+		action, ok := a.script.OnSignal[signalmsg.Signal]
+		if !ok {
+			action = fakeAction{Messages: []channel.Message{fakeAck("")}}
+		}
+		a.play(ctlChannel, action)(req)
+	})
+	if a.script.OnExec != nil {
+		srv.Handle(channel.MSG_EXEC, func(req *server.Request) {
+			a.play(ctlChannel, a.script.OnExec(req.Payload.(*channel.ExecMessage)))(req)
+		})
+	}
+	srv.Handle(channel.MSG_STDIN, a.recordStdin)
+	if !a.script.NoReady {
+		time.Sleep(a.script.ReadyDelay)
+		srv.Ready()
+	}
+	srv.Serve()
+}
+
+// recordStdin keeps the stdin of each process and acks it, as far as the
+// daemon asked for an ack.
+func (a *fakeAgent) recordStdin(req *server.Request) {
+	streammsg := req.Payload.(*channel.StreamMessage)
+	a.Lock()
+	if a.stdin == nil {
+		a.stdin = make(map[string][]byte)
+		a.stdinClosed = make(map[string]bool)
+	}
+	a.stdin[streammsg.ID] = append(a.stdin[streammsg.ID], streammsg.Data...)
+	if streammsg.Closed {
+		a.stdinClosed[streammsg.ID] = true
+	}
+	a.Unlock()
+	req.Ack(nil)
+}
+
+// recordedStdin returns the stdin of process id, and whether it was closed.
+func (a *fakeAgent) recordedStdin(id string) (string, bool) {
+	a.Lock()
+	defer a.Unlock()
+	return string(a.stdin[id]), a.stdinClosed[id]
+}
+
+// play returns the handler playing action in answer to a request, aside so
+// that a delayed action holds up no other request.
+func (a *fakeAgent) play(ctlChannel *channel.MessageChannel, action fakeAction) server.Handler {
+	return func(req *server.Request) {
+		go a.run(ctlChannel, req.ID, action)
+	}
+}
+
+// run plays action in answer to the request id: the replies of the action
+// carry id, the notifications none.
+func (a *fakeAgent) run(ctlChannel *channel.MessageChannel, id uint64, action fakeAction) {
+	time.Sleep(action.Delay)
+	for _, msg := range action.Messages {
+		switch msg.Type {
+		case channel.MSG_ACK, channel.MSG_STATS, channel.MSG_AGENT_HELLO:
+			msg.ID = id
+		}
+		ctlChannel.SendMessage(msg)
+	}
+	if action.PowerOff {
+		// let the channel writer flush, like cvmagent does
+		ctlChannel.Flush()
+		a.vm.Process.Kill()
+	}
+}
+
+func (a *fakeAgent) close() error {
+	err := a.listener.Close()
+	os.Remove(a.vm.config.AgentSocket)
+	return err
+}
@@ -0,0 +1,245 @@
+package gemini
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libcontainer/netlink"
+)
+
+// values of the gemini.gc option
+const (
+	gcOn     = "on"
+	gcOff    = "off"
+	gcDryRun = "dryrun"
+)
+
+// The host resources of the VMs are named with gemini-only prefixes, the
+// garbage collection removes nothing else. The interface names are kept under
+// the 15 bytes of IFNAMSIZ.
+const (
+	socketPrefix = "/tmp/gemini-"
+	bridgePrefix = "gembr-"
+	vethPrefix   = "gemveth"
+)
+
+var (
+	// /tmp/gemini-<id>.sock and the hypervisor sockets, as
+	// /tmp/gemini-<id>.qmp
+	socketName = regexp.MustCompile(`^gemini-([0-9a-f]{64})\.[a-z]+$`)
+	// gembr-N bridges and their /tmp/gembr-N ifup scripts
+	bridgeName = regexp.MustCompile(`^` + bridgePrefix + `[0-9]+$`)
+	// container veths renamed gemvethN by setupNetwork
+	vethName = regexp.MustCompile(`^` + vethPrefix + `[0-9]+$`)
+)
+
+// socketPath returns the path of the socket ext of the VM of container id,
+// "sock" for the agent.
+func socketPath(id, ext string) string {
+	return socketPrefix + id + "." + ext
+}
+
+// orphan is a host resource left by a VM that no live container owns.
+type orphan struct {
+	what   string
+	remove func() error
+}
+
+// CollectGarbage removes the sockets, ifup scripts, bridges, veths and VM
+// processes of VMs that are not running any more, and returns what it
+// removed. With dryRun set nothing is removed, it returns what would be.
+func (d *driver) CollectGarbage(dryRun bool) ([]string, error) {
+	// no Run may set up resources before the snapshot of the owned ones
+	d.gcLock.Lock()
+	defer d.gcLock.Unlock()
+
+	var (
+		removed []string
+		errs    []string
+	)
+	for _, o := range d.findOrphans() {
+		if dryRun {
+			removed = append(removed, o.what)
+			continue
+		}
+		if err := o.remove(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", o.what, err))
+			continue
+		}
+		log.Infof("Removed orphaned %s", o.what)
+		removed = append(removed, o.what)
+	}
+	if len(errs) > 0 {
+		return removed, fmt.Errorf("Collect garbage error: %s", strings.Join(errs, ", "))
+	}
+	return removed, nil
+}
+
+// startupGC runs the garbage collection configured by gemini.gc.
+func (d *driver) startupGC() {
+	if d.options.gc == gcOff {
+		return
+	}
+	d.collectGarbage(d.options.gc == gcDryRun)
+}
+
+// gcOnSignal runs the garbage collection on demand, each time the daemon gets
+// SIGUSR2. It only logs the orphans when gemini.gc is dryrun.
+func (d *driver) gcOnSignal() {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR2)
+	for range sigc {
+		log.Info("Collecting garbage on SIGUSR2")
+		d.collectGarbage(d.options.gc == gcDryRun)
+	}
+}
+
+func (d *driver) collectGarbage(dryRun bool) {
+	orphans, err := d.CollectGarbage(dryRun)
+	if err != nil {
+		log.Error(err)
+	}
+	if dryRun {
+		for _, o := range orphans {
+			log.Infof("Would remove orphaned %s", o)
+		}
+	}
+}
+
+// findOrphans lists the orphaned resources, VM processes first so that
+// their sockets and taps are gone before the rest is removed.
+func (d *driver) findOrphans() []orphan {
+	ownedPids := make(map[int]bool)
+	ownedIDs := make(map[string]bool)
+	owned := make(map[string]bool)
+	d.Lock()
+	for id, active := range d.activeContainers {
+		ownedIDs[id] = true
+		ownedPids[active.pid] = true
+		owned[active.sockPath] = true
+		if n := active.network; n != nil {
+			owned[n.ifupScript] = true
+			owned[n.bridge] = true
+			owned[n.veth] = true
+		}
+	}
+	// a VM restore could not reach is left to the next daemon
+	for id, state := range d.unreachable {
+		ownedIDs[id] = true
+		ownedPids[state.Pid] = true
+		owned[state.VM.AgentSocket] = true
+		if n := state.Network; n != nil {
+			owned[n.IfupScript] = true
+			owned[n.Bridge] = true
+			owned[n.Veth] = true
+		}
+	}
+	d.Unlock()
+
+	var orphans []orphan
+	orphans = append(orphans, d.orphanedVMs(ownedPids, ownedIDs)...)
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Errorf("List interfaces error: %s", err)
+	}
+	for _, iface := range ifaces {
+		name := iface.Name
+		if owned[name] {
+			continue
+		}
+		switch {
+		case bridgeName.MatchString(name):
+			orphans = append(orphans, orphan{"bridge " + name, func() error {
+				if br, err := net.InterfaceByName(name); err == nil {
+					netlink.NetworkLinkDown(br)
+				}
+				return netlink.DeleteBridge(name)
+			}})
+		case vethName.MatchString(name) && isGeminiVeth(name):
+			orphans = append(orphans, orphan{"veth " + name, func() error {
+				return netlink.NetworkLinkDel(name)
+			}})
+		}
+	}
+
+	files, err := ioutil.ReadDir("/tmp")
+	if err != nil {
+		log.Errorf("Read /tmp error: %s", err)
+	}
+	for _, fi := range files {
+		path := filepath.Join("/tmp", fi.Name())
+		if owned[path] {
+			continue
+		}
+		switch {
+		case fi.Mode()&os.ModeSocket != 0:
+			m := socketName.FindStringSubmatch(fi.Name())
+			if m == nil || ownedIDs[m[1]] {
+				continue
+			}
+			orphans = append(orphans, orphan{"socket " + path, func() error {
+				return os.Remove(path)
+			}})
+		case bridgeName.MatchString(fi.Name()) && fi.Mode().IsRegular():
+			orphans = append(orphans, orphan{"ifup script " + path, func() error {
+				return os.Remove(path)
+			}})
+		}
+	}
+	return orphans
+}
+
+// orphanedVMs lists the VM processes started by the driver for a container
+// that is not running.
+func (d *driver) orphanedVMs(ownedPids map[int]bool, ownedIDs map[string]bool) []orphan {
+	vms, err := d.hypervisor.VMs()
+	if err != nil {
+		log.Errorf("List %s VMs error: %s", d.hypervisor.Name(), err)
+		return nil
+	}
+	var orphans []orphan
+	for pid, id := range vms {
+		if ownedPids[pid] || ownedIDs[id] {
+			continue
+		}
+		pid := pid
+		orphans = append(orphans, orphan{fmt.Sprintf("%s process %d (container %s)", d.hypervisor.Name(), pid, id), func() error {
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+				return err
+			}
+			deadline := time.Now().Add(d.options.killTimeout)
+			for syscall.Kill(pid, 0) == nil {
+				if time.Now().After(deadline) {
+					return fmt.Errorf("still running %s after SIGKILL", d.options.killTimeout)
+				}
+				// reaped by init, or by us when it is our child
+				var ws syscall.WaitStatus
+				syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+				time.Sleep(minBackoff)
+			}
+			return nil
+		}})
+	}
+	return orphans
+}
+
+// isGeminiVeth reports whether veth name is a container veth bridged by
+// setupNetwork: it hangs off a gemini bridge, or off none once the bridge is
+// gone.
+func isGeminiVeth(name string) bool {
+	master, err := os.Readlink(filepath.Join("/sys/class/net", name, "master"))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return bridgeName.MatchString(filepath.Base(master))
+}
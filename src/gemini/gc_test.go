@@ -0,0 +1,60 @@
+package gemini
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestFindOrphans checks that the VM and the socket of a container the
+// driver lost are orphans, and those of a running one are not.
+func TestFindOrphans(t *testing.T) {
+	d := newFakeDriver(t, defaultFakeAgentScript())
+	defer os.RemoveAll(d.root)
+	owned := fakeCommand(d, "0a")
+	lost := fakeCommand(d, "0b")
+
+	ownedDone := startFake(t, d, owned)
+	lostDone := startFake(t, d, lost)
+	d.Lock()
+	lostPid := d.activeContainers[lost.ID].pid
+	delete(d.activeContainers, lost.ID)
+	d.Unlock()
+
+	found := make(map[string]orphan)
+	for _, o := range d.findOrphans() {
+		if strings.Contains(o.what, owned.ID) {
+			t.Errorf("%s of a running container is an orphan", o.what)
+		}
+		if strings.Contains(o.what, lost.ID) {
+			found[o.what] = o
+		}
+	}
+	vm := fmt.Sprintf("fake process %d (container %s)", lostPid, lost.ID)
+	socket := "socket " + socketPath(lost.ID, "sock")
+	if _, ok := found[vm]; !ok || len(found) != 2 {
+		t.Fatalf("orphans %v, want %q and %q", found, vm, socket)
+	}
+	if _, ok := found[socket]; !ok {
+		t.Fatalf("orphans %v, want %q and %q", found, vm, socket)
+	}
+
+	if err := found[socket].remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := found[vm].remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(lostPid, 0); err != syscall.ESRCH {
+		t.Errorf("orphaned VM %d still running: %v", lostPid, err)
+	}
+	waitRun(t, lostDone)
+
+	if err := d.Terminate(owned); err != nil {
+		t.Fatal(err)
+	}
+	waitRun(t, ownedDone)
+	checkCleaned(t, d, owned.ID)
+}
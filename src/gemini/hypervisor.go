@@ -0,0 +1,113 @@
+package gemini
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+)
+
+// VMConfig is the VM of a container, as given to the hypervisor.
+type VMConfig struct {
+	ID string
+
+	Memory int64 // MB
+	Cpus   int
+	// host CPUs the vCPUs are pinned to, one per vCPU, empty for none
+	Cpuset []int
+
+	Kernel string
+	Initrd string
+	Append string
+
+	// host directory shared with the guest as the 9p "share_dir" tag
+	SharedDir string
+	// unix socket of the agent channel, the "cvm.channel.0" port
+	AgentSocket string
+	// script adding the tap of the VM to the container bridge
+	TapScript string
+	// file receiving the output of the hypervisor
+	LogPath string
+}
+
+// Hypervisor launches the VMs of the driver. The backend is picked by the
+// gemini.hypervisor option.
+type Hypervisor interface {
+	Name() string
+
+	// Probe checks that the VMs can run on the host, once before any
+	// Launch.
+	Probe() (*Capabilities, error)
+
+	// Config builds the VM config of container id.
+	Config(id string, res *vmResources, network *vmNetwork, sharedDir string) *VMConfig
+
+	// Launch starts the VM of config. It returns once the VM process runs,
+	// the guest is still booting.
+	Launch(config *VMConfig) (VM, error)
+
+	// Reattach takes back the VM of config left running by a previous daemon
+	// as process pid, started at startTime (clock ticks after boot).
+	Reattach(config *VMConfig, pid int, startTime uint64) (VM, error)
+
+	// VMs lists the VM processes of the backend running on the host, by pid,
+	// with the id of their container.
+	VMs() (map[int]string, error)
+}
+
+// VM is a running VM.
+type VM interface {
+	Pid() int
+
+	// Connect sets up the control of the VM while it boots, it gives up
+	// once cancel is closed.
+	Connect(cancel <-chan struct{}) error
+
+	// Done is closed when the VM process exits, Wait returns its status.
+	Done() <-chan struct{}
+	Wait() (*os.ProcessState, error)
+
+	// Kill stops the VM process at once, Powerdown asks the guest to power
+	// off.
+	Kill() error
+	Powerdown() error
+
+	// Pause and Resume stop and restart the vCPUs.
+	Pause() error
+	Resume() error
+	Paused() (bool, error)
+
+	// Stats fills the cost of the VM on the host.
+	Stats(stats *cgroups.Stats) error
+
+	// Hotplug adds the device id, its driver and properties in args, Unplug
+	// removes it.
+	Hotplug(id string, args map[string]interface{}) error
+	Unplug(id string) error
+
+	// Close releases the control connections, the VM keeps running.
+	Close() error
+}
+
+var hypervisors = map[string]func(*vmOptions) Hypervisor{
+	"qemu": newQemuHypervisor,
+}
+
+func hypervisorNames() string {
+	var names []string
+	for name := range hypervisors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newHypervisor(opts *vmOptions) (Hypervisor, error) {
+	newFunc, ok := hypervisors[opts.hypervisor]
+	if !ok {
+		return nil, fmt.Errorf("Unknown hypervisor %q, supported: %s", opts.hypervisor, hypervisorNames())
+	}
+	return newFunc(opts), nil
+}
@@ -2,12 +2,36 @@
 
 package gemini  
 
+import "github.com/docker/docker/daemon/execdriver"
+
 type info struct {
 	ID string
 	driver *driver
 }
 
+// IsRunning reports whether the VM of the container is up, a paused VM
+// still counts as running.
 func (i *info) IsRunning() bool {
+	i.driver.Lock()
+	defer i.driver.Unlock()
 	_, ok := i.driver.activeContainers[i.ID]
 	return ok
 }
+
+// IsPaused reports whether the vCPUs of the VM are stopped by Pause.
+func (i *info) IsPaused() bool {
+	i.driver.Lock()
+	defer i.driver.Unlock()
+	active := i.driver.activeContainers[i.ID]
+	return active != nil && active.paused
+}
+
+// ExitStatus returns the exit status of a container reattached after a
+// daemon restart whose VM exited since: no Run was there to return it. It
+// is kept until Clean, over daemon restarts too.
+func (i *info) ExitStatus() (execdriver.ExitStatus, bool) {
+	i.driver.Lock()
+	defer i.driver.Unlock()
+	status, ok := i.driver.exits[i.ID]
+	return status, ok
+}
@@ -11,8 +11,20 @@ import (
 	"github.com/vishvananda/netns"
 )
 
-// return ipaddr, netmask, qemu-if-up-script-path, error
-func GetIpaddrAndQemuUpScript(namespacePath string) (string, string, string, error) {
+// vmNetwork is the host side network of a VM: the container veth moved out
+// of its namespace and bridged with the qemu tap.
+type vmNetwork struct {
+	ipaddr  string
+	netmask string
+	// qemu-if-up script adding the tap to the bridge
+	ifupScript string
+	bridge     string
+	veth       string
+}
+
+// setupNetwork takes the ip of the container veth for the guest and bridges
+// the veth, moved to the host namespace, with the future qemu tap.
+func setupNetwork(namespacePath string) (*vmNetwork, error) {
 	ipaddr := ""
 	netmask := ""
 	// Save the current network namespace
@@ -34,7 +46,7 @@ func GetIpaddrAndQemuUpScript(namespacePath string) (string, string, string, err
 			if err != nil {
 				//return ipaddr, tapid, err
 				//continue
-				return "", "", "", err
+				return nil, err
 			}
 			ipaddr = (ipv4.(*net.IPNet)).IP.String()
 			mask := (ipv4.(*net.IPNet)).IP.DefaultMask()
@@ -47,32 +59,33 @@ func GetIpaddrAndQemuUpScript(namespacePath string) (string, string, string, err
 	// clear IP
 	ip, ipnet, err := net.ParseCIDR(ipv4.String())
 	if err != nil {
-		return "", "", "", err
+		return nil, err
 	}
 	if err := netlink.NetworkLinkDelIp(&vethInNs, ip, ipnet); err != nil {
-		return "", "", "", err
+		return nil, err
 	}
 
 	// rename interface
 	netlink.NetworkLinkDown(&vethInNs)
-	if err := netlink.NetworkChangeName(&vethInNs, "veth"+fmt.Sprintf("%d", vethInNs.Index)); err != nil {
-		return "", "", "", err
+	vethname := vethPrefix + fmt.Sprintf("%d", vethInNs.Index)
+	if err := netlink.NetworkChangeName(&vethInNs, vethname); err != nil {
+		return nil, err
 	}
 
 	// remove veth from namespace
 	err = netlink.NetworkSetNsPid(&vethInNs, 1)
 	if err != nil {
 		log.Info("networksetnspid error")
-		return "", "", "", err
+		return nil, err
 	}
 	// change namespace
 	netns.Set(origns)
 
 	// Create a new network bridge
-	bridgename := "br-" + fmt.Sprintf("%d", vethInNs.Index)
+	bridgename := bridgePrefix + fmt.Sprintf("%d", vethInNs.Index)
 	err = netlink.CreateBridge(bridgename, true)
 	if err != nil {
-		return "", "", "", err
+		return nil, err
 	}
 
 	// Bring the bridge up
@@ -81,7 +94,7 @@ func GetIpaddrAndQemuUpScript(namespacePath string) (string, string, string, err
 
 	// add veth to bridge
 	if err := netlink.AddToBridge(&vethInNs, br); err != nil {
-		return "", "", "", err
+		return nil, err
 	}
 	netlink.NetworkLinkUp(&vethInNs)
 
@@ -89,9 +102,39 @@ func GetIpaddrAndQemuUpScript(namespacePath string) (string, string, string, err
 	filepath := "/tmp/" + bridgename
 	err = writeQemuIfUp(filepath, bridgename)
 	if err != nil {
-		return "", "", "", err
+		return nil, err
+	}
+	return &vmNetwork{
+		ipaddr:     ipaddr,
+		netmask:    netmask,
+		ifupScript: filepath,
+		bridge:     bridgename,
+		veth:       vethname,
+	}, nil
+}
+
+// teardown removes the bridge, the veth and the ifup script of the VM. The
+// tap went away with qemu.
+func (n *vmNetwork) teardown() error {
+	var errs []string
+	if br, err := net.InterfaceByName(n.bridge); err == nil {
+		netlink.NetworkLinkDown(br)
+		if err := netlink.DeleteBridge(n.bridge); err != nil {
+			errs = append(errs, fmt.Sprintf("delete bridge %s: %s", n.bridge, err))
+		}
 	}
-	return ipaddr, netmask, filepath, nil
+	if _, err := net.InterfaceByName(n.veth); err == nil {
+		if err := netlink.NetworkLinkDel(n.veth); err != nil {
+			errs = append(errs, fmt.Sprintf("delete veth %s: %s", n.veth, err))
+		}
+	}
+	if err := os.Remove(n.ifupScript); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
 }
 
 func writeQemuIfUp(filepath, bridge string) error {
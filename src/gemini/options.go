@@ -0,0 +1,193 @@
+package gemini
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/units"
+)
+
+const (
+	defaultHypervisor = "qemu"
+
+	defaultQemu     = "/usr/bin/qemu-system-x86_64"
+	defaultKernel   = "/home/gemini/vmlinux_4_0_4"
+	defaultInitrd   = "/home/gemini/initramfs2.gz"
+	defaultMachine  = "pc-i440fx-2.0,usb=off"
+	defaultMemory   = 128 // MB
+	defaultOverhead = 32  // MB
+	defaultCpus     = 1
+	defaultAppend   = "console=ttyS0 panic=1"
+	defaultGC       = gcOn
+
+	defaultBootTimeout      = 30 * time.Second
+	defaultStopTimeout      = 10 * time.Second
+	defaultPowerdownTimeout = 10 * time.Second
+	defaultKillTimeout      = 5 * time.Second
+	defaultAgentTimeout     = 10 * time.Second
+	defaultQmpTimeout       = 10 * time.Second
+)
+
+// vmOptions is the VM launch profile shared by every container of the driver.
+// It is filled from the "gemini.*" exec-opts given to the daemon.
+type vmOptions struct {
+	// hypervisor is the backend running the VMs, see hypervisors.
+	hypervisor string
+
+	qemu    string
+	kernel  string
+	initrd  string
+	machine string
+	memory  int64 // MB
+	cpus    int
+	append  string
+
+	// overhead is the memory (MB) added on top of a container's memory
+	// limit to cover the guest kernel and agent.
+	overhead int64
+
+	// bootTimeout bounds the time from the VM spawn to the container start.
+	bootTimeout time.Duration
+
+	// how long Terminate waits for the VM to exit after each stop stage:
+	// the SIGTERM of the workload, the ACPI powerdown and the SIGKILL of the
+	// VM process.
+	stopTimeout      time.Duration
+	powerdownTimeout time.Duration
+	killTimeout      time.Duration
+
+	// agentTimeout bounds each call to the guest agent but the wait for its
+	// announce, which the boot timeout covers.
+	agentTimeout time.Duration
+
+	// qmpTimeout bounds each command to the hypervisor monitor.
+	qmpTimeout time.Duration
+
+	// gc is what the driver does with orphaned VM resources on start: gcOn
+	// removes them, gcDryRun only logs them. On SIGUSR2 they are removed,
+	// or logged with gcDryRun.
+	gc string
+}
+
+func defaultOptions() *vmOptions {
+	return &vmOptions{
+		hypervisor: defaultHypervisor,
+
+		qemu:    defaultQemu,
+		kernel:  defaultKernel,
+		initrd:  defaultInitrd,
+		machine: defaultMachine,
+		memory:  defaultMemory,
+		cpus:    defaultCpus,
+		append:  defaultAppend,
+
+		overhead:         defaultOverhead,
+		bootTimeout:      defaultBootTimeout,
+		stopTimeout:      defaultStopTimeout,
+		powerdownTimeout: defaultPowerdownTimeout,
+		killTimeout:      defaultKillTimeout,
+		agentTimeout:     defaultAgentTimeout,
+		qmpTimeout:       defaultQmpTimeout,
+		gc:               defaultGC,
+	}
+}
+
+// parseOptions parses the driver exec-opts (e.g. "gemini.memory=256m") on top
+// of the defaults. The hypervisor checks the files they name, see Probe.
+func parseOptions(options []string) (*vmOptions, error) {
+	var err error
+	opts := defaultOptions()
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Unable to parse gemini option %q: expected key=value", option)
+		}
+		key, val := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "gemini.hypervisor":
+			if _, ok := hypervisors[val]; !ok {
+				return nil, fmt.Errorf("Invalid gemini.hypervisor %q: supported are %s", val, hypervisorNames())
+			}
+			opts.hypervisor = val
+		case "gemini.qemu":
+			opts.qemu = val
+		case "gemini.kernel":
+			opts.kernel = val
+		case "gemini.initrd":
+			opts.initrd = val
+		case "gemini.machine":
+			if val == "" {
+				return nil, fmt.Errorf("gemini.machine must not be empty")
+			}
+			opts.machine = val
+		case "gemini.memory":
+			size, err := units.RAMInBytes(val)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid gemini.memory %q: %s", val, err)
+			}
+			if size < 1024*1024 {
+				return nil, fmt.Errorf("Invalid gemini.memory %q: must be at least 1MB", val)
+			}
+			opts.memory = size / (1024 * 1024)
+		case "gemini.cpus":
+			cpus, err := strconv.Atoi(val)
+			if err != nil || cpus < 1 {
+				return nil, fmt.Errorf("Invalid gemini.cpus %q: must be a positive integer", val)
+			}
+			opts.cpus = cpus
+		case "gemini.overhead":
+			size, err := units.RAMInBytes(val)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("Invalid gemini.overhead %q", val)
+			}
+			opts.overhead = size / (1024 * 1024)
+		case "gemini.boottimeout":
+			if opts.bootTimeout, err = parseTimeout(key, val); err != nil {
+				return nil, err
+			}
+		case "gemini.stoptimeout":
+			if opts.stopTimeout, err = parseTimeout(key, val); err != nil {
+				return nil, err
+			}
+		case "gemini.powerdowntimeout":
+			if opts.powerdownTimeout, err = parseTimeout(key, val); err != nil {
+				return nil, err
+			}
+		case "gemini.killtimeout":
+			if opts.killTimeout, err = parseTimeout(key, val); err != nil {
+				return nil, err
+			}
+		case "gemini.agenttimeout":
+			if opts.agentTimeout, err = parseTimeout(key, val); err != nil {
+				return nil, err
+			}
+		case "gemini.qmptimeout":
+			if opts.qmpTimeout, err = parseTimeout(key, val); err != nil {
+				return nil, err
+			}
+		case "gemini.gc":
+			switch val {
+			case gcOn, gcOff, gcDryRun:
+				opts.gc = val
+			default:
+				return nil, fmt.Errorf("Invalid gemini.gc %q: must be %s, %s or %s", val, gcOn, gcOff, gcDryRun)
+			}
+		case "gemini.append":
+			opts.append = val
+		default:
+			return nil, fmt.Errorf("Unknown option %s", key)
+		}
+	}
+
+	return opts, nil
+}
+
+func parseTimeout(key, val string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q: must be a positive duration", key, val)
+	}
+	return timeout, nil
+}
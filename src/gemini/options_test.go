@@ -0,0 +1,60 @@
+package gemini
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOptions(t *testing.T) {
+	hypervisors["fake"] = func(o *vmOptions) Hypervisor { return newFakeHypervisor(o, nil) }
+	defer delete(hypervisors, "fake")
+
+	opts, err := parseOptions([]string{
+		"gemini.hypervisor=fake",
+		" GEMINI.Memory = 256m",
+		"gemini.cpus=2",
+		"gemini.overhead=0",
+		"gemini.agenttimeout=1m30s",
+		"gemini.gc=dryrun",
+		"gemini.append=console=ttyS0 quiet",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.memory != 256 || opts.cpus != 2 || opts.overhead != 0 {
+		t.Errorf("memory %d, cpus %d, overhead %d", opts.memory, opts.cpus, opts.overhead)
+	}
+	if opts.agentTimeout != 90*time.Second || opts.gc != gcDryRun || opts.append != "console=ttyS0 quiet" {
+		t.Errorf("agent timeout %s, gc %s, append %q", opts.agentTimeout, opts.gc, opts.append)
+	}
+	if opts.bootTimeout != defaultBootTimeout || opts.machine != defaultMachine {
+		t.Errorf("boot timeout %s, machine %q, want the defaults", opts.bootTimeout, opts.machine)
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		option string
+		want   string
+	}{
+		{"gemini.memory", "expected key=value"},
+		{"gemini.memory=lots", `Invalid gemini.memory "lots"`},
+		{"gemini.memory=512k", "must be at least 1MB"},
+		{"gemini.cpus=0", `Invalid gemini.cpus "0"`},
+		{"gemini.cpus=two", `Invalid gemini.cpus "two"`},
+		{"gemini.overhead=-1m", `Invalid gemini.overhead "-1m"`},
+		{"gemini.boottimeout=0", `Invalid gemini.boottimeout "0"`},
+		{"gemini.stoptimeout=-1s", `Invalid gemini.stoptimeout "-1s"`},
+		{"gemini.qmptimeout=10", `Invalid gemini.qmptimeout "10"`},
+		{"gemini.gc=maybe", `Invalid gemini.gc "maybe"`},
+		{"gemini.hypervisor=xen", `Invalid gemini.hypervisor "xen"`},
+		{"gemini.machine=", "gemini.machine must not be empty"},
+		{"gemini.vcpus=1", "Unknown option gemini.vcpus"},
+	} {
+		_, err := parseOptions([]string{tc.option})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %v, want %q", tc.option, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package gemini
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/execdriver/gemini/qemucmd"
+)
+
+// Capabilities is what NewDriver found out about the hypervisor and the host.
+type Capabilities struct {
+	Hypervisor string
+	Version    string
+	// accelerator the VMs run with, "kvm" or "tcg"
+	Accel    string
+	Machines []string
+	Devices  []string
+	// problems that do not prevent running VMs
+	Warnings []string
+}
+
+func (c *Capabilities) String() string {
+	if c.Accel == "" {
+		return fmt.Sprintf("%s %s", c.Hypervisor, c.Version)
+	}
+	return fmt.Sprintf("%s %s, %s", c.Hypervisor, c.Version, c.Accel)
+}
+
+const (
+	minQemuMajor = 2
+	minQemuMinor = 0
+)
+
+// devices the VMs are made of
+var requiredQemuDevices = []string{
+	"virtio-serial-pci",
+	"virtserialport",
+	"virtio-9p-pci",
+	"virtio-net-pci",
+}
+
+var (
+	qemuVersion = regexp.MustCompile(`version ([0-9]+)\.([0-9]+)(\.[0-9]+)?`)
+	// `name "virtio-net-pci", bus PCI`
+	qemuDevice = regexp.MustCompile(`^name "([^"]+)"`)
+)
+
+// Probe checks that qemu, the guest kernel and the initrd of the options can
+// run the VMs on this host and picks the accelerator: KVM, or TCG with a
+// warning when /dev/kvm is not usable.
+func (h *qemuHypervisor) Probe() (*Capabilities, error) {
+	caps := &Capabilities{Hypervisor: h.Name()}
+
+	fi, err := os.Stat(h.options.qemu)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gemini.qemu %q: %s", h.options.qemu, err)
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return nil, fmt.Errorf("Invalid gemini.qemu %q: not an executable file", h.options.qemu)
+	}
+	for name, path := range map[string]string{
+		"gemini.kernel": h.options.kernel,
+		"gemini.initrd": h.options.initrd,
+	} {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %s", name, path, err)
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q: %s", name, path, err)
+		}
+		if fi.IsDir() {
+			return nil, fmt.Errorf("Invalid %s %q: is a directory", name, path)
+		}
+	}
+
+	out, err := exec.Command(h.options.qemu, "-version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -version: %s", h.options.qemu, err)
+	}
+	m := qemuVersion.FindStringSubmatch(string(out))
+	if m == nil {
+		return nil, fmt.Errorf("%s -version: unexpected output %q", h.options.qemu, out)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	caps.Version = strings.TrimPrefix(m[0], "version ")
+	if major < minQemuMajor || major == minQemuMajor && minor < minQemuMinor {
+		return nil, fmt.Errorf("qemu %s is too old, %d.%d or later is needed", caps.Version, minQemuMajor, minQemuMinor)
+	}
+
+	machine, err := qemucmd.ParseMachine(h.options.machine)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gemini.machine %q: %s", h.options.machine, err)
+	}
+	if caps.Machines, err = h.machineTypes(); err != nil {
+		return nil, err
+	}
+	if !contains(caps.Machines, machine.Type) {
+		return nil, fmt.Errorf("qemu %s does not support machine %s", caps.Version, machine.Type)
+	}
+	if caps.Devices, err = h.deviceNames(); err != nil {
+		return nil, err
+	}
+	for _, device := range requiredQemuDevices {
+		if !contains(caps.Devices, device) {
+			return nil, fmt.Errorf("qemu %s does not support device %s", caps.Version, device)
+		}
+	}
+
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		caps.Warnings = append(caps.Warnings, fmt.Sprintf("no tap devices, containers get no network: %s", err))
+	}
+
+	caps.Accel = machine.Accel
+	if caps.Accel == "" {
+		caps.Accel = "kvm"
+		if f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0); err != nil {
+			caps.Accel = "tcg"
+			caps.Warnings = append(caps.Warnings, fmt.Sprintf("KVM is not usable, falling back to TCG: %s", err))
+		} else {
+			f.Close()
+		}
+	}
+	h.accel = caps.Accel
+
+	for _, warning := range caps.Warnings {
+		log.Warnf("gemini: %s", warning)
+	}
+	return caps, nil
+}
+
+// machineTypes lists the machines of `qemu -machine help`, one per line
+// after the header.
+func (h *qemuHypervisor) machineTypes() ([]string, error) {
+	out, err := exec.Command(h.options.qemu, "-machine", "help").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -machine help: %s", h.options.qemu, err)
+	}
+	var machines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasSuffix(fields[0], ":") {
+			continue
+		}
+		machines = append(machines, fields[0])
+	}
+	return machines, nil
+}
+
+// deviceNames lists the devices of `qemu -device help`, printed on stderr by
+// older versions.
+func (h *qemuHypervisor) deviceNames() ([]string, error) {
+	out, err := exec.Command(h.options.qemu, "-device", "help").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s -device help: %s", h.options.qemu, err)
+	}
+	var devices []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if m := qemuDevice.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			devices = append(devices, m[1])
+		}
+	}
+	return devices, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
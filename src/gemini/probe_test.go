@@ -0,0 +1,42 @@
+package gemini
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestProbeFiles checks the files of the options, before qemu is run.
+func TestProbeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gemini-probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	for _, tc := range []struct {
+		options []string
+		want    string
+	}{
+		{[]string{"gemini.qemu=" + missing}, `Invalid gemini.qemu "` + missing + `"`},
+		{[]string{"gemini.qemu=" + dir}, "not an executable file"},
+		{[]string{"gemini.qemu=" + file}, "not an executable file"},
+		{[]string{"gemini.qemu=/bin/sh", "gemini.kernel=" + missing, "gemini.initrd=" + file}, `Invalid gemini.kernel "` + missing + `"`},
+		{[]string{"gemini.qemu=/bin/sh", "gemini.kernel=" + file, "gemini.initrd=" + dir}, "is a directory"},
+	} {
+		opts, err := parseOptions(tc.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newQemuHypervisor(opts).Probe(); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: error %v, want %q", tc.options, err, tc.want)
+		}
+	}
+}
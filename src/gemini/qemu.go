@@ -0,0 +1,336 @@
+package gemini
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/execdriver/gemini/qemucmd"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+)
+
+var errQmpNotConnected = errors.New("qmp is not connected")
+
+// the agent socket on the qemu command line
+var qemuSocket = regexp.MustCompile(`path=/tmp/gemini-([0-9a-f]{64})\.sock`)
+
+// qemuHypervisor runs the VMs with qemu, controlled through QMP.
+type qemuHypervisor struct {
+	options *vmOptions
+	// accelerator picked by Probe
+	accel string
+}
+
+func newQemuHypervisor(options *vmOptions) Hypervisor {
+	return &qemuHypervisor{options: options}
+}
+
+func (h *qemuHypervisor) Name() string {
+	return "qemu"
+}
+
+func (h *qemuHypervisor) Config(id string, res *vmResources, network *vmNetwork, sharedDir string) *VMConfig {
+	config := &VMConfig{
+		ID:          id,
+		Memory:      res.memory,
+		Cpus:        res.cpus,
+		Cpuset:      res.cpuset,
+		Kernel:      h.options.kernel,
+		Initrd:      h.options.initrd,
+		Append:      h.options.append,
+		SharedDir:   sharedDir,
+		AgentSocket: socketPath(id, "sock"),
+	}
+	if network != nil {
+		config.TapScript = network.ifupScript
+	}
+	return config
+}
+
+func qmpPath(id string) string {
+	return socketPath(id, "qmp")
+}
+
+func (h *qemuHypervisor) args(config *VMConfig) ([]string, error) {
+	machine, err := qemucmd.ParseMachine(h.options.machine)
+	if err != nil {
+		return nil, err
+	}
+	if machine.Accel == "" {
+		machine.Accel = h.accel
+	}
+	cmd := &qemucmd.Cmd{
+		Binary:       h.options.qemu,
+		Machine:      machine,
+		Memory:       config.Memory,
+		Cpus:         config.Cpus,
+		Serial:       "pty",
+		NoUserConfig: true,
+		NoDefaults:   true,
+		NoHPET:       true,
+		NoReboot:     true,
+		NoGraphic:    true,
+		MlockOff:     true,
+		UTCClock:     true,
+		StrictBoot:   true,
+		Kernel: &qemucmd.Kernel{
+			Path:   config.Kernel,
+			Initrd: config.Initrd,
+			Append: config.Append,
+		},
+		QMPSocket: qmpPath(config.ID),
+		Chardevs: []qemucmd.Chardev{
+			{ID: "charch0", Path: config.AgentSocket, Server: true, NoWait: true},
+		},
+		Fsdevs: []qemucmd.Fsdev{
+			{ID: "virtio9p", Path: config.SharedDir, SecurityModel: "none"},
+		},
+		Devices: []qemucmd.Device{
+			qemucmd.VirtioSerial("virtio-serial0", "pci.0", "0x6"),
+			qemucmd.VirtSerialPort("channel0", "virtio-serial0.0", 1, "charch0", "cvm.channel.0"),
+			qemucmd.Virtio9p("virtio9p", "share_dir"),
+		},
+	}
+	if machine.Accel != "tcg" {
+		cmd.Globals = []qemucmd.Global{{Driver: "kvm-pit", Property: "lost_tick_policy", Value: "discard"}}
+	}
+	if len(config.Cpuset) > 0 {
+		// name the vCPU threads so that they can be pinned
+		cmd.Name = config.ID
+		cmd.DebugThreads = true
+	}
+	if config.TapScript != "" {
+		cmd.Netdevs = append(cmd.Netdevs, qemucmd.Netdev{ID: "hostnet0", Script: config.TapScript})
+		cmd.Devices = append(cmd.Devices, qemucmd.VirtioNet("hostnet0"))
+	}
+	return cmd.Args()
+}
+
+func (h *qemuHypervisor) Launch(config *VMConfig) (VM, error) {
+	args, err := h.args(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the workload stdio goes over the agent channel, qemu only gets a log
+	qemuLog, err := os.OpenFile(config.LogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer qemuLog.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return nil, err
+	}
+	defer devNull.Close()
+	attr := &os.ProcAttr{
+		Files: []*os.File{devNull, qemuLog, qemuLog},
+	}
+	p, err := os.StartProcess(h.options.qemu, args, attr)
+	if err != nil {
+		return nil, err
+	}
+	return &qemuVM{vmProcess: newVMProcess(p), config: config, qmpTimeout: h.options.qmpTimeout}, nil
+}
+
+func (h *qemuHypervisor) Reattach(config *VMConfig, pid int, startTime uint64) (VM, error) {
+	if err := h.checkProcess(pid, startTime); err != nil {
+		return nil, err
+	}
+	vm := &qemuVM{vmProcess: adoptVMProcess(pid), config: config, qmpTimeout: h.options.qmpTimeout}
+	qmp, err := dialQmp(qmpPath(config.ID), vm.qmpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	vm.setQmp(qmp)
+	return vm, nil
+}
+
+// checkProcess fails unless pid is still the qemu started at startTime, and
+// not a process reusing the pid.
+func (h *qemuHypervisor) checkProcess(pid int, startTime uint64) error {
+	t, err := processStartTime(pid)
+	if err != nil {
+		return err
+	}
+	if t != startTime {
+		return fmt.Errorf("pid %d is not the qemu of the container any more", pid)
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return err
+	}
+	if argv0 := string(bytes.SplitN(cmdline, []byte{0}, 2)[0]); argv0 != h.options.qemu {
+		return fmt.Errorf("pid %d runs %s, not %s", pid, argv0, h.options.qemu)
+	}
+	return nil
+}
+
+func (h *qemuHypervisor) VMs() (map[int]string, error) {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	vms := make(map[int]string)
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", proc.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		if string(bytes.SplitN(cmdline, []byte{0}, 2)[0]) != h.options.qemu {
+			continue
+		}
+		if m := qemuSocket.FindSubmatch(cmdline); m != nil {
+			vms[pid] = string(m[1])
+		}
+	}
+	return vms, nil
+}
+
+// qemuVM is a qemu process, its monitor is connected by Connect.
+type qemuVM struct {
+	*vmProcess
+	config *VMConfig
+
+	qmp        *qmpClient
+	qmpLock    sync.Mutex
+	qmpTimeout time.Duration
+}
+
+func (vm *qemuVM) Pid() int {
+	return vm.Process.Pid
+}
+
+func (vm *qemuVM) Connect(cancel <-chan struct{}) error {
+	path := qmpPath(vm.config.ID)
+	if err := waitSocket(cancel, path); err != nil {
+		return err
+	}
+	var qmp *qmpClient
+	err := retry(cancel, func() (err error) {
+		qmp, err = dialQmp(path, vm.qmpTimeout)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	vm.setQmp(qmp)
+	return pinVcpus(vm.Pid(), vm.config.Cpuset)
+}
+
+func (vm *qemuVM) setQmp(qmp *qmpClient) {
+	vm.qmpLock.Lock()
+	vm.qmp = qmp
+	vm.qmpLock.Unlock()
+	go watchQmpEvents(vm.config.ID, qmp)
+}
+
+func (vm *qemuVM) monitor() (*qmpClient, error) {
+	vm.qmpLock.Lock()
+	defer vm.qmpLock.Unlock()
+	if vm.qmp == nil {
+		return nil, errQmpNotConnected
+	}
+	return vm.qmp, nil
+}
+
+func (vm *qemuVM) Kill() error {
+	return vm.Process.Kill()
+}
+
+func (vm *qemuVM) Powerdown() error {
+	qmp, err := vm.monitor()
+	if err != nil {
+		return err
+	}
+	return qmp.SystemPowerdown()
+}
+
+func (vm *qemuVM) Pause() error {
+	qmp, err := vm.monitor()
+	if err != nil {
+		return err
+	}
+	return qmp.Stop()
+}
+
+func (vm *qemuVM) Resume() error {
+	qmp, err := vm.monitor()
+	if err != nil {
+		return err
+	}
+	return qmp.Cont()
+}
+
+func (vm *qemuVM) Paused() (bool, error) {
+	qmp, err := vm.monitor()
+	if err != nil {
+		return false, err
+	}
+	status, err := qmp.QueryStatus()
+	if err != nil {
+		return false, err
+	}
+	return status.Status == "paused", nil
+}
+
+func (vm *qemuVM) Stats(stats *cgroups.Stats) error {
+	pid := vm.Pid()
+	if err := qemuCpuStats(pid, &stats.CpuStats); err != nil {
+		return err
+	}
+	rss, err := qemuRss(pid)
+	if err != nil {
+		return err
+	}
+	stats.MemoryStats.Usage.Usage = rss
+	stats.MemoryStats.Stats["qemu_rss"] = rss
+	if err := qemuIoStats(pid, &stats.BlkioStats); err != nil {
+		log.Debugf("Read io stats of qemu %d error: %s", pid, err)
+	}
+	return nil
+}
+
+func (vm *qemuVM) Hotplug(id string, args map[string]interface{}) error {
+	qmp, err := vm.monitor()
+	if err != nil {
+		return err
+	}
+	device := map[string]interface{}{"id": id}
+	for k, v := range args {
+		device[k] = v
+	}
+	return qmp.DeviceAdd(device)
+}
+
+func (vm *qemuVM) Unplug(id string) error {
+	qmp, err := vm.monitor()
+	if err != nil {
+		return err
+	}
+	return qmp.DeviceDel(id)
+}
+
+func (vm *qemuVM) Close() error {
+	vm.qmpLock.Lock()
+	defer vm.qmpLock.Unlock()
+	var err error
+	if vm.qmp != nil {
+		err = vm.qmp.Close()
+		vm.qmp = nil
+	}
+	os.Remove(qmpPath(vm.config.ID))
+	return err
+}
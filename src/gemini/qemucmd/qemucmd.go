@@ -0,0 +1,425 @@
+// Package qemucmd builds the command line of a qemu process from typed
+// settings. Values going into option strings are escaped, settings that
+// cannot go together are rejected and the argv comes out in a fixed order.
+package qemucmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Prop is a key=value property of an option string.
+type Prop struct {
+	Key   string
+	Value string
+}
+
+// Escape quotes a value for an option string, qemu reads ",," as a comma.
+func Escape(s string) string {
+	return strings.Replace(s, ",", ",,", -1)
+}
+
+// option renders name followed by props, as in "socket,id=ch0,path=/x".
+func option(name string, props []Prop) string {
+	parts := []string{}
+	if name != "" {
+		parts = append(parts, Escape(name))
+	}
+	for _, p := range props {
+		if p.Value == "" {
+			parts = append(parts, p.Key)
+			continue
+		}
+		parts = append(parts, p.Key+"="+Escape(p.Value))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Machine is the -machine option.
+type Machine struct {
+	Type string
+	// accelerator, e.g. "kvm" or "tcg", empty for the qemu default
+	Accel string
+	Props []Prop
+}
+
+// ParseMachine splits a -machine string such as "pc-i440fx-2.0,usb=off"
+// into the type and the properties.
+func ParseMachine(s string) (*Machine, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty machine")
+	}
+	m := &Machine{}
+	for i, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		switch {
+		case i == 0 && len(kv) == 1:
+			m.Type = part
+		case len(kv) != 2 || kv[0] == "":
+			return nil, fmt.Errorf("invalid machine property %q", part)
+		case kv[0] == "type" && i == 0:
+			m.Type = kv[1]
+		case kv[0] == "accel":
+			m.Accel = kv[1]
+		default:
+			m.Props = append(m.Props, Prop{kv[0], kv[1]})
+		}
+	}
+	if m.Type == "" {
+		return nil, fmt.Errorf("machine %q has no type", s)
+	}
+	return m, nil
+}
+
+func (m *Machine) args() ([]string, error) {
+	if m.Type == "" {
+		return nil, fmt.Errorf("machine: no type")
+	}
+	props := append([]Prop{}, m.Props...)
+	for _, p := range props {
+		if p.Key == "accel" || p.Key == "type" {
+			return nil, fmt.Errorf("machine: set %s with the field, not as a property", p.Key)
+		}
+	}
+	if m.Accel != "" {
+		props = append(props, Prop{"accel", m.Accel})
+	}
+	return []string{"-machine", option(m.Type, props)}, nil
+}
+
+// Kernel is the direct boot of a kernel.
+type Kernel struct {
+	Path   string
+	Initrd string
+	// kernel command line, handed to qemu as one argument
+	Append string
+}
+
+func (k *Kernel) args() ([]string, error) {
+	if k.Path == "" {
+		return nil, fmt.Errorf("kernel: no path")
+	}
+	args := []string{"-kernel", k.Path}
+	if k.Initrd != "" {
+		args = append(args, "-initrd", k.Initrd)
+	}
+	if k.Append != "" {
+		args = append(args, "-append", k.Append)
+	}
+	return args, nil
+}
+
+// Chardev is a unix socket character device.
+type Chardev struct {
+	ID   string
+	Path string
+	// listen on Path instead of connecting to it
+	Server bool
+	// with Server, do not wait for a client before starting the guest
+	NoWait bool
+}
+
+func (c *Chardev) args() ([]string, error) {
+	if c.Path == "" {
+		return nil, fmt.Errorf("chardev %s: no path", c.ID)
+	}
+	if c.NoWait && !c.Server {
+		return nil, fmt.Errorf("chardev %s: nowait needs server", c.ID)
+	}
+	props := []Prop{{"id", c.ID}, {"path", c.Path}}
+	if c.Server {
+		props = append(props, Prop{"server", ""})
+	}
+	if c.NoWait {
+		props = append(props, Prop{"nowait", ""})
+	}
+	return []string{"-chardev", option("socket", props)}, nil
+}
+
+// Fsdev is a host directory exported to the guest over 9p.
+type Fsdev struct {
+	ID   string
+	Path string
+	// "none", "passthrough" or "mapped"
+	SecurityModel string
+	ReadOnly      bool
+}
+
+func (f *Fsdev) args() ([]string, error) {
+	if f.Path == "" {
+		return nil, fmt.Errorf("fsdev %s: no path", f.ID)
+	}
+	switch f.SecurityModel {
+	case "none", "passthrough", "mapped":
+	default:
+		return nil, fmt.Errorf("fsdev %s: invalid security model %q", f.ID, f.SecurityModel)
+	}
+	props := []Prop{{"id", f.ID}, {"path", f.Path}, {"security_model", f.SecurityModel}}
+	if f.ReadOnly {
+		props = append(props, Prop{"readonly", ""})
+	}
+	return []string{"-fsdev", option("local", props)}, nil
+}
+
+// Netdev is a tap network backend set up by a script.
+type Netdev struct {
+	ID string
+	// script run with the tap name once it exists
+	Script string
+}
+
+func (n *Netdev) args() ([]string, error) {
+	props := []Prop{{"id", n.ID}}
+	if n.Script != "" {
+		props = append(props, Prop{"script", n.Script})
+	}
+	return []string{"-netdev", option("tap", props)}, nil
+}
+
+// Device is a -device option: the driver, its id and properties.
+type Device struct {
+	Driver string
+	ID     string
+	Props  []Prop
+}
+
+func (d *Device) args() ([]string, error) {
+	if d.Driver == "" {
+		return nil, fmt.Errorf("device %s: no driver", d.ID)
+	}
+	props := []Prop{}
+	if d.ID != "" {
+		props = append(props, Prop{"id", d.ID})
+	}
+	props = append(props, d.Props...)
+	return []string{"-device", option(d.Driver, props)}, nil
+}
+
+// VirtioSerial is a virtio-serial PCI controller.
+func VirtioSerial(id, bus, addr string) Device {
+	return Device{Driver: "virtio-serial-pci", ID: id, Props: []Prop{{"bus", bus}, {"addr", addr}}}
+}
+
+// VirtSerialPort is a port of a virtio-serial controller backed by a
+// chardev, named name in the guest.
+func VirtSerialPort(id, bus string, nr int, chardev, name string) Device {
+	return Device{Driver: "virtserialport", ID: id, Props: []Prop{
+		{"bus", bus}, {"nr", strconv.Itoa(nr)}, {"chardev", chardev}, {"name", name}}}
+}
+
+// Virtio9p is the PCI transport of a 9p fsdev, mounted by tag in the guest.
+func Virtio9p(fsdev, tag string) Device {
+	return Device{Driver: "virtio-9p-pci", Props: []Prop{{"fsdev", fsdev}, {"mount_tag", tag}}}
+}
+
+// VirtioNet is a virtio network card on a netdev.
+func VirtioNet(netdev string) Device {
+	return Device{Driver: "virtio-net-pci", Props: []Prop{{"netdev", netdev}}}
+}
+
+// Global sets a property of every device of a driver. qemu reads the value
+// as is, up to the end of the argument: it is not escaped.
+type Global struct {
+	Driver   string
+	Property string
+	Value    string
+}
+
+// Cmd is the whole qemu command line.
+type Cmd struct {
+	Binary string
+
+	// -name, with the vCPU threads named after their index when
+	// DebugThreads is set
+	Name         string
+	DebugThreads bool
+
+	Machine *Machine
+	// guest RAM in MB
+	Memory int64
+	Cpus   int
+	Kernel *Kernel
+
+	Globals []Global
+	// -serial backend, empty for none
+	Serial string
+
+	NoUserConfig bool
+	NoDefaults   bool
+	NoHPET       bool
+	NoReboot     bool
+	NoGraphic    bool
+	MlockOff     bool
+	UTCClock     bool
+	StrictBoot   bool
+
+	// unix socket of the QMP monitor, served by qemu
+	QMPSocket string
+
+	Chardevs []Chardev
+	Fsdevs   []Fsdev
+	Netdevs  []Netdev
+	Devices  []Device
+}
+
+// Args renders the argv of c, the binary first.
+func (c *Cmd) Args() ([]string, error) {
+	if c.Binary == "" {
+		return nil, fmt.Errorf("no qemu binary")
+	}
+	if c.Memory <= 0 {
+		return nil, fmt.Errorf("invalid memory %dMB", c.Memory)
+	}
+	if c.Cpus <= 0 {
+		return nil, fmt.Errorf("invalid cpu count %d", c.Cpus)
+	}
+	if c.DebugThreads && c.Name == "" {
+		return nil, fmt.Errorf("debug-threads needs a name")
+	}
+	if err := c.checkIDs(); err != nil {
+		return nil, err
+	}
+
+	args := []string{c.Binary}
+	add := func(a []string, err error) error {
+		if err != nil {
+			return err
+		}
+		args = append(args, a...)
+		return nil
+	}
+
+	if c.Name != "" {
+		props := []Prop{}
+		if c.DebugThreads {
+			props = append(props, Prop{"debug-threads", "on"})
+		}
+		args = append(args, "-name", option(c.Name, props))
+	}
+	if c.Machine != nil {
+		if err := add(c.Machine.args()); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range c.Globals {
+		args = append(args, "-global", fmt.Sprintf("%s.%s=%s", g.Driver, g.Property, g.Value))
+	}
+	if c.Serial != "" {
+		args = append(args, "-serial", c.Serial)
+	}
+	if c.MlockOff {
+		args = append(args, "-realtime", "mlock=off")
+	}
+	if c.NoUserConfig {
+		args = append(args, "-no-user-config")
+	}
+	if c.NoDefaults {
+		args = append(args, "-nodefaults")
+	}
+	if c.NoHPET {
+		args = append(args, "-no-hpet")
+	}
+	if c.UTCClock {
+		args = append(args, "-rtc", "base=utc,driftfix=slew")
+	}
+	if c.NoReboot {
+		args = append(args, "-no-reboot")
+	}
+	if c.NoGraphic {
+		args = append(args, "-display", "none")
+	}
+	if c.StrictBoot {
+		args = append(args, "-boot", "strict=on")
+	}
+	args = append(args,
+		"-m", strconv.FormatInt(c.Memory, 10),
+		"-smp", strconv.Itoa(c.Cpus))
+	if c.Kernel != nil {
+		if err := add(c.Kernel.args()); err != nil {
+			return nil, err
+		}
+	}
+	if c.QMPSocket != "" {
+		args = append(args, "-qmp", "unix:"+Escape(c.QMPSocket)+",server,nowait")
+	}
+	for i := range c.Chardevs {
+		if err := add(c.Chardevs[i].args()); err != nil {
+			return nil, err
+		}
+	}
+	for i := range c.Fsdevs {
+		if err := add(c.Fsdevs[i].args()); err != nil {
+			return nil, err
+		}
+	}
+	for i := range c.Netdevs {
+		if err := add(c.Netdevs[i].args()); err != nil {
+			return nil, err
+		}
+	}
+	for i := range c.Devices {
+		if err := add(c.Devices[i].args()); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// checkIDs rejects an id used twice, a device pointing to a backend that is
+// not defined, and a global naming its driver or property with a character
+// that would split it differently.
+func (c *Cmd) checkIDs() error {
+	for _, g := range c.Globals {
+		if g.Driver == "" || g.Property == "" ||
+			strings.ContainsAny(g.Driver, ",.=") || strings.ContainsAny(g.Property, ",=") {
+			return fmt.Errorf("global %q: invalid driver or property", g.Driver+"."+g.Property)
+		}
+	}
+
+	backends := map[string]string{}
+	define := func(kind, id string) error {
+		if id == "" {
+			return fmt.Errorf("%s without id", kind)
+		}
+		if other, ok := backends[id]; ok {
+			return fmt.Errorf("%s %s: id already used by a %s", kind, id, other)
+		}
+		backends[id] = kind
+		return nil
+	}
+	for _, ch := range c.Chardevs {
+		if err := define("chardev", ch.ID); err != nil {
+			return err
+		}
+	}
+	for _, fs := range c.Fsdevs {
+		if err := define("fsdev", fs.ID); err != nil {
+			return err
+		}
+	}
+	for _, n := range c.Netdevs {
+		if err := define("netdev", n.ID); err != nil {
+			return err
+		}
+	}
+
+	devices := map[string]bool{}
+	for _, d := range c.Devices {
+		if d.ID != "" {
+			if devices[d.ID] {
+				return fmt.Errorf("device %s: id already used", d.ID)
+			}
+			devices[d.ID] = true
+		}
+		for _, p := range d.Props {
+			switch p.Key {
+			case "chardev", "fsdev", "netdev":
+				if backends[p.Value] != p.Key {
+					return fmt.Errorf("device %s: no %s %s", d.Driver, p.Key, p.Value)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package qemucmd
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// golden compares args with testdata/name.golden, one quoted argument per
+// line so that the argument boundaries show.
+func golden(t *testing.T, name string, args []string) {
+	var b []byte
+	for _, arg := range args {
+		b = append(b, strconv.Quote(arg)+"\n"...)
+	}
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(want) {
+		t.Errorf("%s: argv differs from %s\ngot:\n%swant:\n%s", name, path, b, want)
+	}
+}
+
+// geminiCmd is the command line the driver builds for a VM.
+func geminiCmd() *Cmd {
+	return &Cmd{
+		Binary:       "/usr/bin/qemu-system-x86_64",
+		Name:         "0123456789abcdef",
+		DebugThreads: true,
+		Machine:      &Machine{Type: "pc-i440fx-2.0", Accel: "kvm", Props: []Prop{{"usb", "off"}}},
+		Memory:       160,
+		Cpus:         2,
+		Globals:      []Global{{Driver: "kvm-pit", Property: "lost_tick_policy", Value: "discard"}},
+		Serial:       "pty",
+		NoUserConfig: true,
+		NoDefaults:   true,
+		NoHPET:       true,
+		NoReboot:     true,
+		NoGraphic:    true,
+		MlockOff:     true,
+		UTCClock:     true,
+		StrictBoot:   true,
+		Kernel: &Kernel{
+			Path:   "/var/lib/gemini/vmlinuz",
+			Initrd: "/var/lib/gemini/initrd.img",
+			Append: "console=ttyS0 panic=1",
+		},
+		QMPSocket: "/tmp/gemini-0123456789abcdef.qmp",
+		Chardevs: []Chardev{
+			{ID: "charch0", Path: "/tmp/gemini-0123456789abcdef.sock", Server: true, NoWait: true},
+		},
+		Fsdevs: []Fsdev{
+			{ID: "virtio9p", Path: "/var/lib/docker/mnt/0123456789abcdef", SecurityModel: "none"},
+		},
+		Netdevs: []Netdev{
+			{ID: "hostnet0", Script: "/tmp/gembr-12"},
+		},
+		Devices: []Device{
+			VirtioSerial("virtio-serial0", "pci.0", "0x6"),
+			VirtSerialPort("channel0", "virtio-serial0.0", 1, "charch0", "cvm.channel.0"),
+			Virtio9p("virtio9p", "share_dir"),
+			VirtioNet("hostnet0"),
+		},
+	}
+}
+
+func TestArgs(t *testing.T) {
+	args, err := geminiCmd().Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "gemini", args)
+}
+
+func TestArgsMinimal(t *testing.T) {
+	args, err := (&Cmd{Binary: "qemu", Memory: 128, Cpus: 1}).Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "minimal", args)
+}
+
+func TestEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"":            "",
+		"/plain/path": "/plain/path",
+		"a,b":         "a,,b",
+		",,":          ",,,,",
+		"a,b,c,":      "a,,b,,c,,",
+	} {
+		if got := Escape(in); got != want {
+			t.Errorf("Escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestArgsEscape puts commas in every value that goes into an option string,
+// none may start a new property. The value of a global is the exception: qemu
+// reads it as is.
+func TestArgsEscape(t *testing.T) {
+	cmd := geminiCmd()
+	cmd.Name = "vm,1"
+	cmd.Machine.Props = []Prop{{"usb", "off,on"}}
+	cmd.Globals[0].Value = "a,b"
+	cmd.QMPSocket = "/tmp/q,mp"
+	cmd.Chardevs[0].Path = "/tmp/a,gent.sock"
+	cmd.Fsdevs[0].Path = "/var/lib/docker/mnt/with,comma"
+	cmd.Netdevs[0].Script = "/tmp/if,up"
+	cmd.Devices[3].Props = append(cmd.Devices[3].Props, Prop{"mac", "aa,bb"})
+	args, err := cmd.Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "escape", args)
+}
+
+// TestArgsAppend checks that the kernel command line stays one argument,
+// spaces, quotes and commas included: qemu does not split -append.
+func TestArgsAppend(t *testing.T) {
+	cmd := &Cmd{
+		Binary: "qemu",
+		Memory: 128,
+		Cpus:   1,
+		Kernel: &Kernel{
+			Path:   "/boot/vmlinuz",
+			Append: `console=ttyS0 panic=1 init="/sbin/my init" opts=a,b`,
+		},
+	}
+	args, err := cmd.Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "append", args)
+}
+
+func TestParseMachine(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Machine
+	}{
+		{"pc", Machine{Type: "pc"}},
+		{"type=q35", Machine{Type: "q35"}},
+		{"pc-i440fx-2.0,accel=kvm,usb=off", Machine{Type: "pc-i440fx-2.0", Accel: "kvm", Props: []Prop{{"usb", "off"}}}},
+		{"pc,usb=off,dump-guest-core=off", Machine{Type: "pc", Props: []Prop{{"usb", "off"}, {"dump-guest-core", "off"}}}},
+	} {
+		m, err := ParseMachine(tc.in)
+		if err != nil {
+			t.Errorf("ParseMachine(%q): %s", tc.in, err)
+			continue
+		}
+		if m.Type != tc.want.Type || m.Accel != tc.want.Accel || len(m.Props) != len(tc.want.Props) {
+			t.Errorf("ParseMachine(%q) = %+v, want %+v", tc.in, *m, tc.want)
+			continue
+		}
+		for i := range m.Props {
+			if m.Props[i] != tc.want.Props[i] {
+				t.Errorf("ParseMachine(%q) = %+v, want %+v", tc.in, *m, tc.want)
+			}
+		}
+	}
+}
+
+func TestParseMachineErrors(t *testing.T) {
+	for in, want := range map[string]string{
+		"":              "empty machine",
+		"pc,usb":        `invalid machine property "usb"`,
+		"pc,=off":       `invalid machine property "=off"`,
+		"pc,,usb=off":   `invalid machine property ""`,
+		",usb=off":      `machine ",usb=off" has no type`,
+		"usb=off":       `machine "usb=off" has no type`,
+		"type=":         `machine "type=" has no type`,
+		"usb=off,accel": `invalid machine property "accel"`,
+	} {
+		m, err := ParseMachine(in)
+		if err == nil {
+			t.Errorf("ParseMachine(%q) = %+v, want error %q", in, *m, want)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseMachine(%q) error %q, want %q", in, err, want)
+		}
+	}
+}
+
+func TestArgsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(*Cmd)
+		want   string
+	}{
+		{"no binary", func(c *Cmd) { c.Binary = "" }, "no qemu binary"},
+		{"no memory", func(c *Cmd) { c.Memory = 0 }, "invalid memory 0MB"},
+		{"no cpus", func(c *Cmd) { c.Cpus = -1 }, "invalid cpu count -1"},
+		{"debug threads without name", func(c *Cmd) { c.Name = "" }, "debug-threads needs a name"},
+		{"machine without type", func(c *Cmd) { c.Machine.Type = "" }, "machine: no type"},
+		{"machine accel property", func(c *Cmd) { c.Machine.Props = []Prop{{"accel", "tcg"}} }, "machine: set accel with the field"},
+		// type is the first element only, ParseMachine keeps a later one
+		// as a property
+		{"machine type property", func(c *Cmd) { c.Machine, _ = ParseMachine("pc,type=q35") }, "machine: set type with the field"},
+		{"kernel without path", func(c *Cmd) { c.Kernel.Path = "" }, "kernel: no path"},
+		{"chardev without path", func(c *Cmd) { c.Chardevs[0].Path = "" }, "chardev charch0: no path"},
+		{"chardev nowait client", func(c *Cmd) { c.Chardevs[0].Server = false }, "chardev charch0: nowait needs server"},
+		{"fsdev security model", func(c *Cmd) { c.Fsdevs[0].SecurityModel = "mapped-xattr" }, `fsdev virtio9p: invalid security model "mapped-xattr"`},
+		{"device without driver", func(c *Cmd) { c.Devices[0].Driver = "" }, "device virtio-serial0: no driver"},
+		{"global without driver", func(c *Cmd) { c.Globals[0].Driver = "" }, `global ".lost_tick_policy": invalid driver or property`},
+		{"global without property", func(c *Cmd) { c.Globals[0].Property = "" }, `global "kvm-pit.": invalid driver or property`},
+		{"global driver comma", func(c *Cmd) { c.Globals[0].Driver = "kvm,pit" }, `global "kvm,pit.lost_tick_policy": invalid driver or property`},
+		{"global driver dot", func(c *Cmd) { c.Globals[0].Driver = "kvm.pit" }, `global "kvm.pit.lost_tick_policy": invalid driver or property`},
+		{"global property comma", func(c *Cmd) { c.Globals[0].Property = "lost,tick" }, `global "kvm-pit.lost,tick": invalid driver or property`},
+		{"global property equal", func(c *Cmd) { c.Globals[0].Property = "lost=tick" }, `global "kvm-pit.lost=tick": invalid driver or property`},
+
+		// checkIDs
+		{"chardev without id", func(c *Cmd) { c.Chardevs[0].ID = "" }, "chardev without id"},
+		{"fsdev without id", func(c *Cmd) { c.Fsdevs[0].ID = "" }, "fsdev without id"},
+		{"netdev without id", func(c *Cmd) { c.Netdevs[0].ID = "" }, "netdev without id"},
+		{"duplicate chardev", func(c *Cmd) { c.Chardevs = append(c.Chardevs, c.Chardevs[0]) }, "chardev charch0: id already used by a chardev"},
+		{"fsdev reusing a chardev id", func(c *Cmd) { c.Fsdevs[0].ID = "charch0" }, "fsdev charch0: id already used by a chardev"},
+		{"netdev reusing an fsdev id", func(c *Cmd) { c.Netdevs[0].ID = "virtio9p" }, "netdev virtio9p: id already used by a fsdev"},
+		{"duplicate device", func(c *Cmd) { c.Devices[1].ID = "virtio-serial0" }, "device virtio-serial0: id already used"},
+		{"missing chardev", func(c *Cmd) { c.Chardevs[0].ID = "charch1" }, "device virtserialport: no chardev charch0"},
+		{"missing fsdev", func(c *Cmd) { c.Fsdevs = nil }, "device virtio-9p-pci: no fsdev virtio9p"},
+		{"missing netdev", func(c *Cmd) { c.Netdevs = nil }, "device virtio-net-pci: no netdev hostnet0"},
+		{"backend of another kind", func(c *Cmd) { c.Devices[3] = VirtioNet("charch0") }, "device virtio-net-pci: no netdev charch0"},
+	} {
+		cmd := geminiCmd()
+		tc.modify(cmd)
+		args, err := cmd.Args()
+		if err == nil {
+			t.Errorf("%s: no error, argv %q", tc.name, args)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error %q, want %q", tc.name, err, tc.want)
+		}
+	}
+}
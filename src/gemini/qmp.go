@@ -0,0 +1,383 @@
+package gemini
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// QMP events the driver cares about
+const (
+	qmpEventShutdown       = "SHUTDOWN"
+	qmpEventStop           = "STOP"
+	qmpEventResume         = "RESUME"
+	qmpEventGuestPanicked  = "GUEST_PANICKED"
+	qmpEventBalloonChanged = "BALLOON_CHANGE"
+)
+
+var errQmpClosed = errors.New("qmp connection closed")
+
+// QmpTimeoutError is returned by a QMP command QEMU did not answer in time.
+type QmpTimeoutError struct {
+	Command string
+	Timeout time.Duration
+}
+
+func (e *QmpTimeoutError) Error() string {
+	return fmt.Sprintf("gemini: qmp did not answer %s within %s", e.Command, e.Timeout)
+}
+
+// qmpEvent is an asynchronous event sent by QEMU.
+type qmpEvent struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+func (e *qmpEvent) Time() time.Time {
+	return time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*1000)
+}
+
+// qmpError is an error returned by QEMU for a command.
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *qmpError) Error() string {
+	return fmt.Sprintf("qmp %s: %s", e.Class, e.Desc)
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        uint64      `json:"id"`
+}
+
+// qmpMessage is anything QEMU sends: the greeting, a response or an event.
+type qmpMessage struct {
+	QMP    *json.RawMessage `json:"QMP"`
+	Return json.RawMessage  `json:"return"`
+	Error  *qmpError        `json:"error"`
+	ID     uint64           `json:"id"`
+	qmpEvent
+}
+
+type qmpResponse struct {
+	ret json.RawMessage
+	err error
+}
+
+// qmpClient talks to the QMP (QEMU Machine Protocol) monitor of a VM.
+type qmpClient struct {
+	conn    net.Conn
+	enc     *json.Encoder
+	dec     *json.Decoder
+	subs    []chan *qmpEvent
+	nextID  uint64
+	pending map[uint64]chan qmpResponse
+	err     error
+	sync.Mutex
+	// serializes the commands on the connection, apart from the lock above
+	// so that the responses and events flow while one is written
+	writeLock sync.Mutex
+
+	// timeout bounds the negotiation, and the write and the response of each
+	// command
+	timeout time.Duration
+}
+
+// dialQmp connects to the QMP socket at path and negotiates the
+// capabilities. Events are delivered to the subscribers from then on.
+func dialQmp(path string, timeout time.Duration) (*qmpClient, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	q := &qmpClient{
+		conn:    conn,
+		enc:     json.NewEncoder(conn),
+		dec:     json.NewDecoder(conn),
+		pending: make(map[uint64]chan qmpResponse),
+		timeout: timeout,
+	}
+
+	// a wedged monitor must not hang the negotiation either
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// the server greets first, then waits for qmp_capabilities
+	var greeting qmpMessage
+	if err := q.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp greeting: %s", err)
+	}
+	if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp greeting: unexpected message")
+	}
+	if err := q.enc.Encode(qmpCommand{Execute: "qmp_capabilities"}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		var msg qmpMessage
+		if err := q.dec.Decode(&msg); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("qmp capabilities: %s", err)
+		}
+		if msg.Event != "" {
+			continue
+		}
+		if msg.Error != nil {
+			conn.Close()
+			return nil, msg.Error
+		}
+		break
+	}
+	conn.SetDeadline(time.Time{})
+
+	go q.read()
+	return q, nil
+}
+
+func (q *qmpClient) read() {
+	for {
+		var msg qmpMessage
+		if err := q.dec.Decode(&msg); err != nil {
+			q.shutdown(err)
+			return
+		}
+		if msg.Event != "" {
+			event := msg.qmpEvent
+			log.Debugf("qmp event: %s", event.Event)
+			q.Lock()
+			for _, sub := range q.subs {
+				select {
+				case sub <- &event:
+				default:
+					log.Warnf("qmp event %s dropped", event.Event)
+				}
+			}
+			q.Unlock()
+			continue
+		}
+		q.Lock()
+		ch := q.pending[msg.ID]
+		delete(q.pending, msg.ID)
+		q.Unlock()
+		if ch == nil {
+			log.Warnf("qmp response for unknown command %d", msg.ID)
+			continue
+		}
+		if msg.Error != nil {
+			ch <- qmpResponse{err: msg.Error}
+		} else {
+			ch <- qmpResponse{ret: msg.Return}
+		}
+	}
+}
+
+// shutdown fails the pending commands and closes the subscriptions.
+func (q *qmpClient) shutdown(err error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.err != nil {
+		return
+	}
+	q.err = errQmpClosed
+	log.Debugf("qmp connection closed: %s", err)
+	for id, ch := range q.pending {
+		ch <- qmpResponse{err: errQmpClosed}
+		delete(q.pending, id)
+	}
+	for _, sub := range q.subs {
+		close(sub)
+	}
+	q.subs = nil
+}
+
+// Subscribe returns a channel receiving the asynchronous events sent by
+// QEMU. The channel is closed with the connection.
+func (q *qmpClient) Subscribe() <-chan *qmpEvent {
+	sub := make(chan *qmpEvent, 64)
+	q.Lock()
+	defer q.Unlock()
+	if q.err != nil {
+		close(sub)
+		return sub
+	}
+	q.subs = append(q.subs, sub)
+	return sub
+}
+
+// Unsubscribe stops the delivery of events to sub.
+func (q *qmpClient) Unsubscribe(sub <-chan *qmpEvent) {
+	q.Lock()
+	defer q.Unlock()
+	for i, s := range q.subs {
+		if s == sub {
+			q.subs = append(q.subs[:i], q.subs[i+1:]...)
+			close(s)
+			return
+		}
+	}
+}
+
+// Execute runs the command with the given arguments and decodes the return
+// value into result, when it is not nil. It fails with a *QmpTimeoutError
+// when QEMU does not take the command or answer it within the timeout of the
+// client.
+func (q *qmpClient) Execute(command string, arguments interface{}, result interface{}) error {
+	ch := make(chan qmpResponse, 1)
+	q.Lock()
+	if q.err != nil {
+		q.Unlock()
+		return q.err
+	}
+	q.nextID++
+	id := q.nextID
+	q.pending[id] = ch
+	q.Unlock()
+
+	if err := q.write(qmpCommand{Execute: command, Arguments: arguments, ID: id}); err != nil {
+		q.Lock()
+		delete(q.pending, id)
+		q.Unlock()
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return &QmpTimeoutError{Command: command, Timeout: q.timeout}
+		}
+		return err
+	}
+
+	var resp qmpResponse
+	select {
+	case resp = <-ch:
+	case <-time.After(q.timeout):
+		// a late response is dropped as one of an unknown command
+		q.Lock()
+		delete(q.pending, id)
+		q.Unlock()
+		return &QmpTimeoutError{Command: command, Timeout: q.timeout}
+	}
+	if resp.err != nil {
+		return resp.err
+	}
+	if result == nil || len(resp.ret) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.ret, result)
+}
+
+// write sends cmd within the timeout. A command cut short leaves the stream
+// unusable, so a failed write closes the connection.
+func (q *qmpClient) write(cmd qmpCommand) error {
+	q.writeLock.Lock()
+	defer q.writeLock.Unlock()
+	q.conn.SetWriteDeadline(time.Now().Add(q.timeout))
+	if err := q.enc.Encode(cmd); err != nil {
+		q.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (q *qmpClient) Close() error {
+	return q.conn.Close()
+}
+
+// qmpStatus is the result of query-status.
+type qmpStatus struct {
+	Running    bool   `json:"running"`
+	Singlestep bool   `json:"singlestep"`
+	Status     string `json:"status"`
+}
+
+// qmpCpu is an entry of the result of query-cpus.
+type qmpCpu struct {
+	CPU      int  `json:"CPU"`
+	Current  bool `json:"current"`
+	Halted   bool `json:"halted"`
+	ThreadID int  `json:"thread_id"`
+}
+
+// qmpBalloon is the result of query-balloon.
+type qmpBalloon struct {
+	Actual int64 `json:"actual"`
+}
+
+func (q *qmpClient) QueryStatus() (*qmpStatus, error) {
+	status := &qmpStatus{}
+	if err := q.Execute("query-status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (q *qmpClient) QueryCpus() ([]qmpCpu, error) {
+	var cpus []qmpCpu
+	if err := q.Execute("query-cpus", nil, &cpus); err != nil {
+		return nil, err
+	}
+	return cpus, nil
+}
+
+func (q *qmpClient) QueryBalloon() (*qmpBalloon, error) {
+	balloon := &qmpBalloon{}
+	if err := q.Execute("query-balloon", nil, balloon); err != nil {
+		return nil, err
+	}
+	return balloon, nil
+}
+
+// Stop pauses the vCPUs.
+func (q *qmpClient) Stop() error {
+	return q.Execute("stop", nil, nil)
+}
+
+// Cont resumes the vCPUs.
+func (q *qmpClient) Cont() error {
+	return q.Execute("cont", nil, nil)
+}
+
+// SystemPowerdown sends an ACPI power button event to the guest.
+func (q *qmpClient) SystemPowerdown() error {
+	return q.Execute("system_powerdown", nil, nil)
+}
+
+// Quit terminates QEMU.
+func (q *qmpClient) Quit() error {
+	return q.Execute("quit", nil, nil)
+}
+
+// DeviceAdd hotplugs a device, args holds the driver and its properties.
+func (q *qmpClient) DeviceAdd(args map[string]interface{}) error {
+	return q.Execute("device_add", args, nil)
+}
+
+// DeviceDel unplugs the device id.
+func (q *qmpClient) DeviceDel(id string) error {
+	return q.Execute("device_del", map[string]string{"id": id}, nil)
+}
+
+// watchQmpEvents logs the events of the VM of container id until the QMP
+// connection goes away.
+func watchQmpEvents(id string, q *qmpClient) {
+	for event := range q.Subscribe() {
+		switch event.Event {
+		case qmpEventGuestPanicked:
+			log.Errorf("VM of container %s: guest panicked", id)
+		case qmpEventShutdown, qmpEventStop, qmpEventResume, qmpEventBalloonChanged:
+			log.Infof("VM of container %s: %s", id, event.Event)
+		default:
+			log.Debugf("VM of container %s: %s", id, event.Event)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package gemini
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMonitor listens on a QMP socket in a temporary directory. serve is run
+// on the connection once the capabilities are negotiated.
+func fakeMonitor(t *testing.T, serve func(conn net.Conn, r *bufio.Reader)) (string, func()) {
+	dir, err := ioutil.TempDir("", "gemini-qmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "qmp")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte(`{"return": {}}` + "\n"))
+		serve(conn, r)
+	}()
+	return path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQmpExecute(t *testing.T) {
+	path, done := fakeMonitor(t, func(conn net.Conn, r *bufio.Reader) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var cmd qmpCommand
+			json.Unmarshal([]byte(line), &cmd)
+			var resp map[string]interface{}
+			switch cmd.Execute {
+			case "query-status":
+				resp = map[string]interface{}{"return": map[string]interface{}{"running": true, "status": "running"}}
+			default:
+				resp = map[string]interface{}{"error": map[string]string{"class": "CommandNotFound", "desc": "no " + cmd.Execute}}
+			}
+			resp["id"] = cmd.ID
+			json.NewEncoder(conn).Encode(resp)
+		}
+	})
+	defer done()
+
+	q, err := dialQmp(path, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	status, err := q.QueryStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running || status.Status != "running" {
+		t.Errorf("status %+v", *status)
+	}
+	err = q.Execute("unknown", nil, nil)
+	if qerr, ok := err.(*qmpError); !ok || qerr.Class != "CommandNotFound" {
+		t.Errorf("error %v, want a CommandNotFound qmpError", err)
+	}
+}
+
+// TestQmpWriteTimeout checks that a monitor not reading its commands fails
+// them in time, and that its events still come meanwhile.
+func TestQmpWriteTimeout(t *testing.T) {
+	quit := make(chan struct{})
+	path, done := fakeMonitor(t, func(conn net.Conn, r *bufio.Reader) {
+		time.Sleep(100 * time.Millisecond)
+		conn.Write([]byte(`{"event": "STOP", "timestamp": {"seconds": 1, "microseconds": 0}}` + "\n"))
+		<-quit
+	})
+	defer done()
+	defer close(quit)
+
+	timeout := 500 * time.Millisecond
+	q, err := dialQmp(path, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	events := q.Subscribe()
+
+	// larger than the socket buffer, the write blocks
+	errc := make(chan error, 1)
+	go func() {
+		errc <- q.DeviceAdd(map[string]interface{}{"id": strings.Repeat("x", 8<<20)})
+	}()
+	select {
+	case event := <-events:
+		if event.Event != qmpEventStop {
+			t.Errorf("event %s, want %s", event.Event, qmpEventStop)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event while a command is written")
+	}
+	select {
+	case err := <-errc:
+		if _, ok := err.(*QmpTimeoutError); !ok {
+			t.Fatalf("error %v, want a QmpTimeoutError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command did not time out")
+	}
+	// the connection was closed with the command cut short
+	if err := q.Stop(); err == nil {
+		t.Error("command sent on a connection cut short")
+	}
+}
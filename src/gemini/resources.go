@@ -0,0 +1,184 @@
+package gemini
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/execdriver"
+)
+
+// vmResources is the sizing of one VM derived from the container's
+// execdriver.Resources.
+type vmResources struct {
+	// memory is the guest RAM in MB, overhead included.
+	memory int64
+	cpus   int
+	// cpuset lists the host CPUs the vCPU threads are pinned to, one per
+	// vCPU. Empty means no pinning.
+	cpuset []int
+
+	// memoryLimit and memorySwap are the ceilings (bytes) applied to the
+	// workload inside the guest; 0 means unlimited.
+	memoryLimit int64
+	memorySwap  int64
+}
+
+// vmResourcesFor maps the docker resource limits onto a VM, falling back to
+// the driver defaults for anything left unset.
+func (d *driver) vmResourcesFor(r *execdriver.Resources) (*vmResources, error) {
+	res := &vmResources{
+		memory: d.options.memory,
+		cpus:   d.options.cpus,
+	}
+	if r == nil {
+		return res, nil
+	}
+
+	if r.Memory > 0 {
+		if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+			return nil, fmt.Errorf("Memory swap limit %d must be larger than memory limit %d", r.MemorySwap, r.Memory)
+		}
+		mb := (r.Memory + 1024*1024 - 1) / (1024 * 1024)
+		res.memory = mb + d.options.overhead
+		res.memoryLimit = r.Memory
+		res.memorySwap = r.MemorySwap
+	}
+	if res.memory*1024*1024 > d.machineMemory {
+		return nil, fmt.Errorf("Cannot allocate %dMB for the VM: host has %dMB of memory", res.memory, d.machineMemory/(1024*1024))
+	}
+
+	online := onlineCpus()
+	if r.CpuShares > 0 {
+		// 1024 shares is one full CPU. Shares are a relative weight that
+		// may exceed the host, a heavier one than the host gets all of it.
+		res.cpus = int((r.CpuShares + 1023) / 1024)
+		if res.cpus > len(online) {
+			res.cpus = len(online)
+		}
+	}
+	if r.CpusetCpus != "" {
+		cpuset, err := parseCpuset(r.CpusetCpus)
+		if err != nil {
+			return nil, err
+		}
+		for _, cpu := range cpuset {
+			if !online[cpu] {
+				return nil, fmt.Errorf("Invalid cpuset %q: host CPU %d is not online", r.CpusetCpus, cpu)
+			}
+		}
+		if r.CpuShares == 0 || res.cpus > len(cpuset) {
+			res.cpus = len(cpuset)
+		}
+		res.cpuset = cpuset[:res.cpus]
+	}
+	if res.cpus > len(online) {
+		return nil, fmt.Errorf("Cannot allocate %d vCPUs: host has %d CPUs online", res.cpus, len(online))
+	}
+	return res, nil
+}
+
+// onlineCpus returns the set of the host CPUs that are online. Their numbers
+// may have holes, and runtime.NumCPU counts the CPUs of the daemon affinity
+// instead.
+func onlineCpus() map[int]bool {
+	online := make(map[int]bool)
+	b, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	if err == nil {
+		var cpus []int
+		if cpus, err = parseCpuset(strings.TrimSpace(string(b))); err == nil {
+			for _, cpu := range cpus {
+				online[cpu] = true
+			}
+			return online
+		}
+	}
+	log.Warnf("Read online CPUs error: %s, assuming %d", err, runtime.NumCPU())
+	for cpu := 0; cpu < runtime.NumCPU(); cpu++ {
+		online[cpu] = true
+	}
+	return online
+}
+
+// parseCpuset parses a cpuset list such as "0-2,5" into sorted CPU numbers.
+func parseCpuset(val string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(val, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		lo, err := strconv.Atoi(bounds[0])
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("Invalid cpuset %q", val)
+		}
+		hi := lo
+		if len(bounds) == 2 {
+			if hi, err = strconv.Atoi(bounds[1]); err != nil || hi < lo {
+				return nil, fmt.Errorf("Invalid cpuset %q", val)
+			}
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			seen[cpu] = true
+		}
+	}
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// pinVcpus pins the vCPU threads of the QEMU process pid to the host CPUs of
+// cpuset. QEMU must be started with debug-threads=on so that vCPU threads are
+// named "CPU <n>/KVM".
+func pinVcpus(pid int, cpuset []int) error {
+	if len(cpuset) == 0 {
+		return nil
+	}
+	tasks, err := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/comm", pid))
+	if err != nil {
+		return err
+	}
+	pinned := 0
+	for _, task := range tasks {
+		b, err := ioutil.ReadFile(task)
+		if err != nil {
+			continue
+		}
+		var vcpu int
+		if _, err := fmt.Sscanf(string(b), "CPU %d/", &vcpu); err != nil || vcpu >= len(cpuset) {
+			continue
+		}
+		tid, err := strconv.Atoi(filepath.Base(filepath.Dir(task)))
+		if err != nil {
+			continue
+		}
+		if err := setAffinity(tid, cpuset[vcpu]); err != nil {
+			return fmt.Errorf("Pin vCPU %d to CPU %d error: %s", vcpu, cpuset[vcpu], err)
+		}
+		pinned++
+	}
+	if pinned != len(cpuset) {
+		return fmt.Errorf("Pinned %d of %d vCPU threads of qemu %d", pinned, len(cpuset), pid)
+	}
+	return nil
+}
+
+func setAffinity(tid, cpu int) error {
+	var mask [1024 / 64]uint64
+	if cpu >= len(mask)*64 {
+		return fmt.Errorf("CPU %d is beyond the affinity mask", cpu)
+	}
+	mask[cpu/64] |= 1 << uint(cpu%64)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package gemini
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/daemon/execdriver"
+)
+
+func TestParseCpuset(t *testing.T) {
+	for _, tc := range []struct {
+		val  string
+		cpus []int
+	}{
+		{"0", []int{0}},
+		{"0-2,5", []int{0, 1, 2, 5}},
+		{"3,1,1-2", []int{1, 2, 3}},
+		{"7-7", []int{7}},
+	} {
+		cpus, err := parseCpuset(tc.val)
+		if err != nil || !reflect.DeepEqual(cpus, tc.cpus) {
+			t.Errorf("%q: %v, %v, want %v", tc.val, cpus, err, tc.cpus)
+		}
+	}
+	for _, val := range []string{"", "a", "-1", "2-1", "1-", "0-2-3", "0,,1", " 1"} {
+		if cpus, err := parseCpuset(val); err == nil {
+			t.Errorf("%q: %v, want an error", val, cpus)
+		}
+	}
+}
+
+func TestVMResourcesFor(t *testing.T) {
+	var online []string
+	var first, offline int
+	for cpu := range onlineCpus() {
+		online = append(online, strconv.Itoa(cpu))
+		if len(online) == 1 || cpu < first {
+			first = cpu
+		}
+		if cpu >= offline {
+			offline = cpu + 1
+		}
+	}
+	ncpu := len(online)
+	min := func(a, b int) int {
+		if a < b {
+			return a
+		}
+		return b
+	}
+	d := &driver{
+		options:       &vmOptions{memory: 128, cpus: 1, overhead: 32},
+		machineMemory: 4 << 30,
+	}
+	for _, tc := range []struct {
+		r    *execdriver.Resources
+		want vmResources
+	}{
+		{nil, vmResources{memory: 128, cpus: 1}},
+		{&execdriver.Resources{}, vmResources{memory: 128, cpus: 1}},
+		{&execdriver.Resources{Memory: 100 << 20},
+			vmResources{memory: 132, cpus: 1, memoryLimit: 100 << 20}},
+		// rounded up to the MB
+		{&execdriver.Resources{Memory: 1, MemorySwap: 2 << 20},
+			vmResources{memory: 33, cpus: 1, memoryLimit: 1, memorySwap: 2 << 20}},
+		{&execdriver.Resources{CpuShares: 2048}, vmResources{memory: 128, cpus: min(2, ncpu)}},
+		{&execdriver.Resources{CpuShares: 1 << 20}, vmResources{memory: 128, cpus: ncpu}},
+		{&execdriver.Resources{CpusetCpus: strconv.Itoa(first)},
+			vmResources{memory: 128, cpus: 1, cpuset: []int{first}}},
+		// the shares bound the vCPUs of a larger cpuset
+		{&execdriver.Resources{CpusetCpus: strings.Join(online, ","), CpuShares: 1024},
+			vmResources{memory: 128, cpus: 1, cpuset: []int{first}}},
+		{&execdriver.Resources{CpusetCpus: strconv.Itoa(first), CpuShares: 4096},
+			vmResources{memory: 128, cpus: 1, cpuset: []int{first}}},
+	} {
+		res, err := d.vmResourcesFor(tc.r)
+		if err != nil {
+			t.Errorf("%+v: %s", tc.r, err)
+			continue
+		}
+		if !reflect.DeepEqual(*res, tc.want) {
+			t.Errorf("%+v: %+v, want %+v", tc.r, *res, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		r    *execdriver.Resources
+		want string
+	}{
+		{&execdriver.Resources{Memory: 2 << 20, MemorySwap: 1 << 20}, "must be larger than memory limit"},
+		{&execdriver.Resources{Memory: 8 << 30}, "host has 4096MB of memory"},
+		{&execdriver.Resources{CpusetCpus: "x"}, `Invalid cpuset "x"`},
+		{&execdriver.Resources{CpusetCpus: strconv.Itoa(offline)}, fmt.Sprintf("host CPU %d is not online", offline)},
+	} {
+		if res, err := d.vmResourcesFor(tc.r); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: %+v, %v, want %q", tc.r, res, err, tc.want)
+		}
+	}
+}
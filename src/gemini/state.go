@@ -0,0 +1,310 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cvm/cvmagent/channel"
+
+	"github.com/docker/docker/daemon/execdriver"
+)
+
+const (
+	stateFile = "state.json"
+	// exit status of a reattached container, see info.ExitStatus
+	exitFile = "exit.json"
+
+	// connections to the agent of a reattached VM before it is left alone
+	reattachAttempts = 3
+)
+
+// containerState is what is kept on disk, under d.root/<id>, about a running
+// VM so that a restarted daemon can take it back.
+type containerState struct {
+	Pid int
+	// start time of the VM process in clock ticks after boot, tells a
+	// reused pid apart
+	StartTime  uint64
+	Hypervisor string
+	VM         *VMConfig
+	Network    *networkState
+	Resources  resourcesState
+}
+
+type networkState struct {
+	IPAddr     string
+	Netmask    string
+	IfupScript string
+	Bridge     string
+	Veth       string
+}
+
+type resourcesState struct {
+	Memory      int64
+	Cpus        int
+	Cpuset      []int
+	MemoryLimit int64
+	MemorySwap  int64
+}
+
+// saveState writes the state file of container id.
+func (d *driver) saveState(id string, active *SafeContainer) error {
+	startTime, err := processStartTime(active.pid)
+	if err != nil {
+		return err
+	}
+	state := containerState{
+		Pid:        active.pid,
+		StartTime:  startTime,
+		Hypervisor: d.hypervisor.Name(),
+		VM:         active.config,
+		Resources: resourcesState{
+			Memory:      active.res.memory,
+			Cpus:        active.res.cpus,
+			Cpuset:      active.res.cpuset,
+			MemoryLimit: active.res.memoryLimit,
+			MemorySwap:  active.res.memorySwap,
+		},
+	}
+	if n := active.network; n != nil {
+		state.Network = &networkState{
+			IPAddr:     n.ipaddr,
+			Netmask:    n.netmask,
+			IfupScript: n.ifupScript,
+			Bridge:     n.bridge,
+			Veth:       n.veth,
+		}
+	}
+	return writeJSON(filepath.Join(d.root, id, stateFile), state)
+}
+
+// saveExit writes the exit status of container id, for Info after another
+// daemon restart.
+func (d *driver) saveExit(id string, status execdriver.ExitStatus) error {
+	return writeJSON(filepath.Join(d.root, id, exitFile), status)
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// write then rename, a crash leaves the old file or the new one
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func loadState(path string) (*containerState, error) {
+	state := &containerState{}
+	if err := readJSON(path, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// restore brings the VMs still running from a previous daemon back into
+// activeContainers, and the exit status of those gone since back for Info.
+// The state of a VM that is gone is removed, the one of a VM running whose
+// agent does not answer is kept for the next daemon.
+func (d *driver) restore() {
+	dirs, err := ioutil.ReadDir(d.root)
+	if err != nil {
+		log.Errorf("Read %s error: %s", d.root, err)
+		return
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		id := dir.Name()
+		var status execdriver.ExitStatus
+		if err := readJSON(filepath.Join(d.root, id, exitFile), &status); err == nil {
+			d.Lock()
+			d.exits[id] = status
+			d.Unlock()
+		} else if !os.IsNotExist(err) {
+			log.Errorf("Load exit status of %s error: %s", id, err)
+		}
+
+		path := filepath.Join(d.root, id, stateFile)
+		state, err := loadState(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Errorf("Load state of %s error: %s", id, err)
+			}
+			continue
+		}
+		if err := d.reattach(id, state); err != nil {
+			log.Warnf("Reattach container %s error: %s", id, err)
+			d.Lock()
+			_, kept := d.unreachable[id]
+			d.Unlock()
+			if !kept {
+				os.Remove(path)
+			}
+			continue
+		}
+		log.Infof("Reattached container %s, %s %d", id, state.Hypervisor, state.Pid)
+	}
+}
+
+// reattach checks that the VM of state still runs and reconnects to its
+// agent and hypervisor. A VM running whose agent does not answer is recorded
+// in d.unreachable.
+func (d *driver) reattach(id string, state *containerState) error {
+	if state.Hypervisor != d.hypervisor.Name() || state.VM == nil {
+		return fmt.Errorf("VM not run by %s", d.hypervisor.Name())
+	}
+	vm, err := d.hypervisor.Reattach(state.VM, state.Pid, state.StartTime)
+	if err != nil {
+		return err
+	}
+	paused, err := vm.Paused()
+	if err != nil {
+		vm.Close()
+		return err
+	}
+
+	agent, err := d.connectAgent(state.VM.AgentSocket)
+	if err != nil {
+		vm.Close()
+		d.Lock()
+		d.unreachable[id] = state
+		d.Unlock()
+		return fmt.Errorf("%s %d runs but its agent does not answer, leaving it alone: %s", state.Hypervisor, state.Pid, err)
+	}
+
+	active := &SafeContainer{pid: state.Pid,
+		vm:       vm,
+		config:   state.VM,
+		sockPath: state.VM.AgentSocket,
+		agent:    agent,
+		res: &vmResources{
+			memory:      state.Resources.Memory,
+			cpus:        state.Resources.Cpus,
+			cpuset:      state.Resources.Cpuset,
+			memoryLimit: state.Resources.MemoryLimit,
+			memorySwap:  state.Resources.MemorySwap,
+		},
+		paused: paused}
+	if n := state.Network; n != nil {
+		active.network = &vmNetwork{
+			ipaddr:     n.IPAddr,
+			netmask:    n.Netmask,
+			ifupScript: n.IfupScript,
+			bridge:     n.Bridge,
+			veth:       n.Veth,
+		}
+	}
+	d.Lock()
+	d.activeContainers[id] = active
+	d.Unlock()
+
+	// nobody runs the container any more: keep the exit status the agent
+	// reports for Info, and release the VM once it is gone
+	exitChan := make(chan *channel.ContainerExitMessage, 1)
+	go func() {
+		if exit, err := agent.WaitExit(); err == nil {
+			exitChan <- exit
+		}
+	}()
+	go func() {
+		vm.Wait()
+		log.Infof("VM of reattached container %s exited", id)
+		var status *execdriver.ExitStatus
+		select {
+		case exit := <-exitChan:
+			s := exitStatus(exit)
+			status = &s
+		case <-time.After(exitStatusTimeout):
+			log.Warnf("VM of reattached container %s exited without reporting the container exit status", id)
+		}
+
+		d.Lock()
+		if d.activeContainers[id] != active {
+			// cleaned already
+			d.Unlock()
+			return
+		}
+		delete(d.activeContainers, id)
+		if status != nil {
+			d.exits[id] = *status
+		}
+		d.Unlock()
+
+		d.release(id, active)
+		// the directory stays for the exit status and the hypervisor log,
+		// Clean removes it
+		os.Remove(filepath.Join(d.root, id, stateFile))
+		if status != nil {
+			if err := d.saveExit(id, *status); err != nil {
+				log.Errorf("Save exit status of %s error: %s", id, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// connectAgent connects to the agent of a reattached VM, a few times over
+// for a guest too busy to answer right when the daemon restarts.
+func (d *driver) connectAgent(url string) (*libagent, error) {
+	var agent *libagent
+	cancel := make(chan struct{})
+	attempts := 0
+	err := retry(cancel, func() error {
+		if attempts++; attempts == reattachAttempts {
+			close(cancel)
+		}
+		agent = &libagent{
+			protocol: "unix",
+			url:      url,
+			timeout:  d.options.agentTimeout,
+		}
+		conn, err := agent.Dial()
+		if err != nil {
+			return err
+		}
+		if err := agent.Init(conn); err != nil {
+			return err
+		}
+		// the agent announced itself to the previous daemon already
+		if err := agent.Hello(nil); err != nil {
+			agent.Destroy()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// processStartTime returns the start time of process pid, in clock ticks
+// after boot.
+func processStartTime(pid int) (uint64, error) {
+	fields, err := procStat(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 22 {
+		return 0, fmt.Errorf("Invalid /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[22-1], 10, 64)
+}
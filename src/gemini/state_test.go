@@ -0,0 +1,98 @@
+package gemini
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cvm/cvmagent/channel"
+)
+
+// waitStopped waits for the VM of container id to be released by d.
+func waitStopped(t *testing.T, d *driver, id string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for d.Info(id).IsRunning() {
+		if time.Now().After(deadline) {
+			t.Fatalf("container %s still running", id)
+		}
+		time.Sleep(minBackoff)
+	}
+}
+
+func TestReattachExit(t *testing.T) {
+	d := newFakeDriver(t, defaultFakeAgentScript())
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "re")
+	done := startFake(t, d, c)
+
+	// the daemon restarts, no Run waits for the container any more
+	restarted := restartFakeDriver(t, d.root, defaultFakeAgentScript())
+	if !restarted.Info(c.ID).IsRunning() {
+		t.Fatal("container not reattached")
+	}
+	if err := restarted.Kill(c, int(syscall.SIGTERM)); err != nil {
+		t.Fatal(err)
+	}
+	waitRun(t, done)
+	waitStopped(t, restarted, c.ID)
+
+	status, ok := restarted.Info(c.ID).(*info).ExitStatus()
+	if !ok || status.ExitCode != 143 {
+		t.Fatalf("exit status %+v, %v, want exit code 143", status, ok)
+	}
+	if _, err := os.Stat(filepath.Join(d.root, c.ID, stateFile)); !os.IsNotExist(err) {
+		t.Errorf("state of a VM gone left behind: %v", err)
+	}
+
+	// and it outlives the next restart, until Clean
+	again := restartFakeDriver(t, d.root, defaultFakeAgentScript())
+	if status, ok := again.Info(c.ID).(*info).ExitStatus(); !ok || status.ExitCode != 143 {
+		t.Fatalf("exit status after a restart %+v, %v, want exit code 143", status, ok)
+	}
+	if err := again.Clean(c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := again.Info(c.ID).(*info).ExitStatus(); ok {
+		t.Error("exit status kept after Clean")
+	}
+	checkCleaned(t, again, c.ID)
+}
+
+// TestReattachUnreachable restarts the daemon while the agent is too slow to
+// answer the hello in time: the VM is left alone, its state kept.
+func TestReattachUnreachable(t *testing.T) {
+	hello := channel.NewHello()
+	hello.Codecs = []string{channel.CODEC_JSON}
+	script := defaultFakeAgentScript()
+	script.On[channel.MSG_HELLO] = fakeAction{
+		Delay:    300 * time.Millisecond,
+		Messages: []channel.Message{fakeMessage(channel.MSG_AGENT_HELLO, hello)},
+	}
+	d := newFakeDriver(t, script)
+	defer os.RemoveAll(d.root)
+	c := fakeCommand(d, "un")
+	done := startFake(t, d, c)
+
+	restarted := restartFakeDriver(t, d.root, script, "gemini.agenttimeout=100ms")
+	if restarted.Info(c.ID).IsRunning() {
+		t.Fatal("container reattached without an answer to the hello")
+	}
+	if _, err := os.Stat(filepath.Join(d.root, c.ID, stateFile)); err != nil {
+		t.Errorf("state of an unreachable VM: %v", err)
+	}
+	for _, o := range restarted.findOrphans() {
+		if strings.Contains(o.what, c.ID) {
+			t.Errorf("%s of an unreachable VM is an orphan", o.what)
+		}
+	}
+
+	if err := d.Kill(c, int(syscall.SIGKILL)); err != nil {
+		t.Fatal(err)
+	}
+	if res := waitRun(t, done); res.err != nil {
+		t.Fatal(res.err)
+	}
+}
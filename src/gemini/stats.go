@@ -0,0 +1,245 @@
+package gemini
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/execdriver"
+	"github.com/opencontainers/runc/libcontainer"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+)
+
+// clockTicks is USER_HZ, the unit of the cpu times in /proc
+const clockTicks = 100
+
+// Stats reports the cost of the VM on the host, as measured by the
+// hypervisor, and the traffic of its veth. The cpu usage is the one of the
+// VM, in the terms of SystemUsage and split over the host CPUs. The memory
+// usage of the workload inside the guest replaces the one of the VM when the
+// agent answers, it is the one the memory limit applies to.
+func (d *driver) Stats(id string) (*execdriver.ResourceStats, error) {
+	d.Lock()
+	active := d.activeContainers[id]
+	var paused bool
+	if active != nil {
+		paused = active.paused
+	}
+	d.Unlock()
+	if active == nil {
+		return nil, fmt.Errorf("active container for %s does not exist", id)
+	}
+
+	now := time.Now()
+	cg := cgroups.NewStats()
+	if err := active.vm.Stats(cg); err != nil {
+		return nil, err
+	}
+
+	// a paused guest cannot answer
+	if !paused {
+		guest, err := active.agent.Stats(nil)
+		if err != nil {
+			log.Errorf("Get guest stats of %s error: %s", id, err)
+		} else {
+			cg.MemoryStats.Usage = cgroups.MemoryData{
+				Usage:    guest.MemoryUsage,
+				MaxUsage: guest.MemoryMaxUsage,
+				Failcnt:  guest.MemoryFailcnt,
+			}
+			cg.MemoryStats.Cache = guest.MemoryCache
+		}
+	}
+
+	stats := &libcontainer.Stats{CgroupStats: cg}
+	if active.network != nil {
+		iface, err := interfaceStats(active.network.veth)
+		if err != nil {
+			log.Debugf("Read network stats of %s error: %s", active.network.veth, err)
+		} else {
+			stats.Interfaces = append(stats.Interfaces, iface)
+		}
+	}
+
+	memoryLimit := active.res.memoryLimit
+	if memoryLimit == 0 {
+		memoryLimit = active.res.memory * 1024 * 1024
+	}
+	systemUsage, err := systemCpuUsage()
+	if err != nil {
+		return nil, err
+	}
+	return &execdriver.ResourceStats{
+		Stats:       stats,
+		Read:        now,
+		MemoryLimit: memoryLimit,
+		SystemUsage: systemUsage,
+	}, nil
+}
+
+// qemuCpuStats fills the cpu times of the qemu process pid. A thread time
+// is accounted to the host cpu the thread last ran on.
+func qemuCpuStats(pid int, stats *cgroups.CpuStats) error {
+	tasks, err := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/stat", pid))
+	if err != nil {
+		return err
+	}
+	if len(tasks) == 0 {
+		return fmt.Errorf("qemu %d is not running", pid)
+	}
+	percpu := make([]uint64, runtime.NumCPU())
+	usage := &stats.CpuUsage
+	for _, task := range tasks {
+		fields, err := procStat(task)
+		if err != nil || len(fields) < 39 {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[14-1], 10, 64)
+		stime, _ := strconv.ParseUint(fields[15-1], 10, 64)
+		cpu, _ := strconv.Atoi(fields[39-1])
+		utime = utime * uint64(time.Second) / clockTicks
+		stime = stime * uint64(time.Second) / clockTicks
+		usage.UsageInUsermode += utime
+		usage.UsageInKernelmode += stime
+		usage.TotalUsage += utime + stime
+		if cpu < len(percpu) {
+			percpu[cpu] += utime + stime
+		}
+	}
+	usage.PercpuUsage = percpu
+	return nil
+}
+
+// procStat returns the fields of the stat file of a process or a thread at
+// path, field n of proc(5) at index n-1.
+func procStat(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// the command, field 2, is in parentheses and may hold spaces and
+	// parentheses itself
+	s := string(b)
+	open, end := strings.Index(s, "("), strings.LastIndex(s, ")")
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("Invalid %s", path)
+	}
+	fields := []string{strings.TrimSpace(s[:open]), s[open+1 : end]}
+	return append(fields, strings.Fields(s[end+1:])...), nil
+}
+
+// qemuRss returns the resident memory of the qemu process pid in bytes.
+func qemuRss(pid int) (uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// qemuIoStats fills the bytes read and written by the qemu process pid, it
+// covers the 9p rootfs of the guest.
+func qemuIoStats(pid int, stats *cgroups.BlkioStats) error {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "read_bytes:":
+			stats.IoServiceBytesRecursive = append(stats.IoServiceBytesRecursive,
+				cgroups.BlkioStatEntry{Op: "Read", Value: value})
+		case "write_bytes:":
+			stats.IoServiceBytesRecursive = append(stats.IoServiceBytesRecursive,
+				cgroups.BlkioStatEntry{Op: "Write", Value: value})
+		}
+	}
+	return scanner.Err()
+}
+
+// interfaceStats reads the counters of the container veth. It is the
+// container end of the pair, so its counters are the ones of the container.
+func interfaceStats(veth string) (*libcontainer.NetworkInterface, error) {
+	iface := &libcontainer.NetworkInterface{Name: "eth0"}
+	for _, counter := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"rx_bytes", &iface.RxBytes},
+		{"rx_packets", &iface.RxPackets},
+		{"rx_errors", &iface.RxErrors},
+		{"rx_dropped", &iface.RxDropped},
+		{"tx_bytes", &iface.TxBytes},
+		{"tx_packets", &iface.TxPackets},
+		{"tx_errors", &iface.TxErrors},
+		{"tx_dropped", &iface.TxDropped},
+	} {
+		b, err := ioutil.ReadFile(filepath.Join("/sys/class/net", veth, "statistics", counter.name))
+		if err != nil {
+			return nil, err
+		}
+		if *counter.value, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return iface, nil
+}
+
+// systemCpuUsage returns the cpu time of the host in nanoseconds, the
+// baseline for the cpu percentage of the container.
+func systemCpuUsage() (uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[0] != "cpu" {
+			continue
+		}
+		var total uint64
+		for _, field := range fields[1:8] {
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid /proc/stat cpu line: %s", scanner.Text())
+			}
+			total += v
+		}
+		return total * uint64(time.Second) / clockTicks, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("No cpu line in /proc/stat")
+}
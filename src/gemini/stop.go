@@ -0,0 +1,69 @@
+package gemini
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// StopStage is the step of Terminate that got the VM to exit.
+type StopStage string
+
+const (
+	StopStageAgent     StopStage = "workload SIGTERM"
+	StopStagePowerdown StopStage = "ACPI powerdown"
+	StopStageKill      StopStage = "VM SIGKILL"
+)
+
+// stopVM stops the VM of active, each stage waiting for the VM to exit
+// within its timeout before the next one is tried:
+//   - the agent sends SIGTERM to the workload, the guest powers off when it
+//     exited,
+//   - the guest gets an ACPI power button event from the hypervisor,
+//   - the VM process is killed.
+func (d *driver) stopVM(active *SafeContainer) (StopStage, error) {
+	vm := active.vm
+
+	// a paused guest cannot handle any of the graceful stages, it is
+	// resumed outside of the driver lock like Unpause does
+	active.pauseLock.Lock()
+	if d.isPaused(active) {
+		if err := vm.Resume(); err != nil {
+			log.Errorf("Resume VM error: %s", err)
+		} else {
+			d.setPaused(active, false)
+		}
+	}
+	active.pauseLock.Unlock()
+
+	// the agent may never answer, the stage is bounded by waiting on the VM
+	// and the call given up with it
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go func() {
+		if err := active.agent.StopContainer(cancel); err != nil {
+			log.Errorf("Stop container error: %s", err)
+		}
+	}()
+	if exitedWithin(vm, d.options.stopTimeout) {
+		return StopStageAgent, nil
+	}
+	log.Warnf("VM %d still running %s after SIGTERM of the workload", vm.Pid(), d.options.stopTimeout)
+
+	if err := vm.Powerdown(); err != nil {
+		log.Errorf("ACPI powerdown error: %s", err)
+	} else if exitedWithin(vm, d.options.powerdownTimeout) {
+		return StopStagePowerdown, nil
+	} else {
+		log.Warnf("VM %d still running %s after ACPI powerdown", vm.Pid(), d.options.powerdownTimeout)
+	}
+
+	// fails when the VM just exited on its own, the wait below tells
+	if err := vm.Kill(); err != nil {
+		log.Debugf("Kill VM %d error: %s", vm.Pid(), err)
+	}
+	if !exitedWithin(vm, d.options.killTimeout) {
+		return "", fmt.Errorf("VM %d still running %s after SIGKILL", vm.Pid(), d.options.killTimeout)
+	}
+	return StopStageKill, nil
+}